@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"libdb.so/hypnoview/lib/hypnohub/popular"
+)
+
+func handleArchived(archiver *popular.Archiver, loc *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		period, err := popular.ParseTimePeriod(chi.URLParam(r, "period"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		date, err := time.ParseInLocation(popular.ArchiveDateFormat, chi.URLParam(r, "date"), loc)
+		if err != nil {
+			http.Error(w, "invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+
+		archived, err := archiver.Lookup(period, date)
+		if err != nil {
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				http.Error(w, "not archived", http.StatusNotFound)
+			case errors.Is(err, popular.ErrNotArchivable):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				slog.Error("cannot look up archived posts", "period", period, "date", date, "err", err)
+				http.Error(w, "cannot look up archived posts", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		writeJSON(w, archived)
+	}
+}
+
+func handleArchiveDates(archive *popular.Archive) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		period, err := popular.ParseTimePeriod(chi.URLParam(r, "period"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dates, err := archive.Dates(period)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dates == nil {
+			dates = []string{}
+		}
+
+		writeJSON(w, archiveDatesResponse{Period: period, Dates: dates})
+	}
+}
+
+type archiveDatesResponse struct {
+	Period popular.TimePeriod `json:"period"`
+	Dates  []string           `json:"dates"`
+}
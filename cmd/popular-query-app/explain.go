@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub/popular"
+)
+
+// handleExplain estimates the popular query from scratch and shows every
+// search made while doing so. Unlike handlePopular, the request's context is
+// used, so the estimate stops once the client goes away.
+func handleExplain(updater *popular.PopularQueryUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parsePopularQueryOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		explanation, err := updater.Explain(r.Context(), opts)
+		if explanation == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var errString string
+		if err != nil {
+			errString = err.Error()
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, explainResponse{
+				Query:  explanation.Query.String(),
+				Since:  explanation.Since,
+				Probes: explanation.Trace.Probes(),
+				Error:  errString,
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "period: %v\n", opts.Period)
+		fmt.Fprintf(w, "since:  %s\n", explanation.Since.Format(time.RFC3339))
+		fmt.Fprintf(w, "query:  %s\n", explanation.Query)
+		if errString != "" {
+			fmt.Fprintf(w, "error:  %s\n", errString)
+		}
+		fmt.Fprintln(w)
+		explanation.Trace.WriteTo(w)
+	}
+}
+
+type explainResponse struct {
+	Query  string                  `json:"query"`
+	Since  time.Time               `json:"since"`
+	Probes []popular.EstimateProbe `json:"probes"`
+	Error  string                  `json:"error,omitempty"`
+}
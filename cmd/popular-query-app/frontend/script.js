@@ -1,9 +1,21 @@
 const queryError = document.querySelector("#query-error");
+const queryNotice = document.querySelector("#query-notice");
+const timezoneInput = document.querySelector("#timezone input");
 const queryResult = document.querySelector("#query-result");
+const baseQuery = document.querySelector("#base-query");
 const generateButtons = document.querySelectorAll("#query-generate .time-period-buttons button");
 const openHypnohubButton = document.querySelector("#open-hypnohub");
 const copyQueryResultButton = document.querySelector("#copy-query-result");
 const helpButton = document.querySelector("#help-button");
+const postsGallery = document.querySelector("#posts-gallery");
+const loadMorePostsButton = document.querySelector("#load-more-posts");
+
+const localTimezone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+document.querySelector("#timezone .name").textContent = localTimezone;
+
+let queryURL = "";
+let postsURL = "";
+let postsPage = 0;
 
 window.copyInput = function (selector) {
   const input = document.querySelector(selector);
@@ -18,17 +30,49 @@ async function generateButtonPress(button) {
   const period = button.id;
 
   queryResult.value = "";
+  queryURL = "";
   queryError.textContent = "";
+  queryNotice.textContent = "";
+  postsGallery.replaceChildren();
+  loadMorePostsButton.hidden = true;
   disableAllButtons();
 
   try {
-    const response = await fetch(`/api/popular/${period}`);
+    const params = new URLSearchParams();
+    // Every timezone costs the server its own estimates, so only ask for
+    // one if the user picked it.
+    if (timezoneInput.checked) {
+      params.set("tz", localTimezone);
+    }
+    if (baseQuery.value.trim() != "") {
+      params.set("q", baseQuery.value.trim());
+    }
+    const rating = document.querySelector("#rating input:checked").value;
+    if (rating != "") {
+      params.set("rating", rating);
+    }
+
+    const response = await fetch(`/api/popular/${period}?${params}`, {
+      headers: { Accept: "application/json" },
+    });
     if (!response.ok) {
-      throw new Error(`HTTP ${response.status}`);
+      const message = await response.text();
+      throw new Error(`HTTP ${response.status}: ${message}`);
     }
 
-    queryResult.value = await response.text();
+    const result = await response.json();
+    queryResult.value = result.query;
+    queryURL = result.url;
+    queryNotice.textContent = result.notice ?? "";
     button.dataset.chosen = true;
+
+    if (result.notice) {
+      // The posts must match the query that was actually returned.
+      params.delete("tz");
+    }
+    postsURL = `/api/popular/${period}/posts?${params}`;
+    postsPage = 0;
+    await loadPosts();
   } catch (err) {
     console.error(err);
     queryError.textContent = err.message;
@@ -37,6 +81,42 @@ async function generateButtonPress(button) {
   }
 }
 
+async function loadPosts() {
+  loadMorePostsButton.disabled = true;
+
+  try {
+    const response = await fetch(`${postsURL}&page=${postsPage}`);
+    if (!response.ok) {
+      const message = await response.text();
+      throw new Error(`HTTP ${response.status}: ${message}`);
+    }
+
+    const result = await response.json();
+    for (const post of result.posts) {
+      const link = document.createElement("a");
+      link.href = post.url;
+      link.target = "_blank";
+      link.title = `Score: ${post.score}\n${post.tags.join(" ")}`;
+
+      const image = document.createElement("img");
+      image.src = post.preview_url;
+      image.alt = `Post #${post.id}`;
+      image.loading = "lazy";
+
+      link.append(image);
+      postsGallery.append(link);
+    }
+
+    postsPage++;
+    loadMorePostsButton.hidden = !result.has_more;
+  } catch (err) {
+    console.error(err);
+    queryError.textContent = err.message;
+  } finally {
+    loadMorePostsButton.disabled = false;
+  }
+}
+
 function disableAllButtons(disabled = true) {
   for (const button of generateButtons) {
     button.disabled = disabled;
@@ -54,20 +134,14 @@ for (const button of generateButtons) {
 copyQueryResultButton.addEventListener("click", () => window.copyInput("#query-result"));
 
 openHypnohubButton.addEventListener("click", () => {
-  if (queryResult.value == "") {
+  if (queryURL == "") {
     return;
   }
-
-  const query = queryResult.value;
-  const params = new URLSearchParams();
-  params.set("page", "post");
-  params.set("tags", query);
-  params.set("s", "list");
-
-  const url = `https://hypnohub.net/index.php?${params.toString()}`;
-  window.open(url, "_blank");
+  window.open(queryURL, "_blank");
 });
 
+loadMorePostsButton.addEventListener("click", () => loadPosts());
+
 helpButton.addEventListener("click", (ev) => {
   if (document.location.hash == "#about") {
     ev.preventDefault();
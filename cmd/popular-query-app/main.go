@@ -5,6 +5,9 @@ import (
 	"crypto/sha256"
 	"embed"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"log"
@@ -12,7 +15,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -23,19 +31,53 @@ import (
 	"libdb.so/hypnoview/lib/httputil"
 	"libdb.so/hypnoview/lib/hypnohub"
 	"libdb.so/hypnoview/lib/hypnohub/popular"
+	"libdb.so/hypnoview/lib/hypnohub/query"
 )
 
 //go:embed frontend/*
 var frontendFS embed.FS
 
 var (
-	httpAddr = ":8080"
-	verbose  = false
+	httpAddr    = ":8080"
+	verbose     = false
+	weekStart   = "monday"
+	periodRules = popular.DefaultPeriodRules
+	offsetsFile = ""
+	interpolate = false
+	anchorsFile = ""
+	stateFile   = ""
+	archiveDir  = ""
+	archiveTZ   = "UTC"
+	explain     = false
+	trendingOn  = true
+	status      = ""
+	waitTimeout = 30 * time.Second
+	refreshTime = popular.DefaultRefreshTimeout
 )
 
+// retryAfter is how long clients are told to wait before retrying a request
+// that timed out.
+const retryAfter = 15 * time.Second
+
 func main() {
 	pflag.StringVarP(&httpAddr, "listen-address", "l", httpAddr, "HTTP address to listen on")
 	pflag.BoolVarP(&verbose, "verbose", "v", verbose, "verbose logging")
+	pflag.StringVar(&weekStart, "week-start", weekStart, "first day of the week")
+	pflag.IntVar(&periodRules.WeekCarryOverDays, "week-carry-over", periodRules.WeekCarryOverDays, "days into the week during which last week is still included")
+	pflag.IntVar(&periodRules.MonthCarryOverDays, "month-carry-over", periodRules.MonthCarryOverDays, "days into the month during which last month is still included")
+	pflag.IntVar(&periodRules.YearCarryOverDays, "year-carry-over", periodRules.YearCarryOverDays, "days into the year during which last year is still included")
+	pflag.BoolVar(&periodRules.IncludeYesterday, "include-yesterday", periodRules.IncludeYesterday, "include the day before in daily periods")
+	pflag.StringVar(&offsetsFile, "offsets-file", offsetsFile, "JSON file to persist learned post offsets in")
+	pflag.BoolVar(&interpolate, "interpolate", interpolate, "estimate periods using ID interpolation instead of binary search")
+	pflag.StringVar(&status, "estimate-status", status, "only search posts with this status (such as active) while estimating periods, keeping offsets stable when posts are deleted or pending")
+	pflag.StringVar(&anchorsFile, "anchors-file", anchorsFile, "JSON file to persist known post creation times in, implies --interpolate")
+	pflag.StringVar(&stateFile, "state-file", stateFile, "JSON file to persist computed popular queries in across restarts")
+	pflag.StringVar(&archiveDir, "archive-dir", archiveDir, "directory to archive the top posts of each ended period in")
+	pflag.StringVar(&archiveTZ, "archive-timezone", archiveTZ, "timezone that archived periods start in")
+	pflag.BoolVar(&explain, "explain", explain, "enable the /api/popular/{period}/explain debugging endpoint, which searches hypnohub on every request")
+	pflag.DurationVar(&waitTimeout, "wait-timeout", waitTimeout, "maximum time a request waits for a popular query to be computed")
+	pflag.DurationVar(&refreshTime, "refresh-timeout", refreshTime, "maximum time spent computing a single popular query")
+	pflag.BoolVar(&trendingOn, "trending", trendingOn, "enable the /api/trending endpoint, which polls hypnohub once it is first requested")
 	pflag.Parse()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -47,6 +89,14 @@ func main() {
 }
 
 func run(ctx context.Context) error {
+	// Background work that must finish before exiting, such as the final
+	// save of the anchors, is waited for once ctx is cancelled.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	minLevel := slog.LevelInfo
 	if verbose {
 		minLevel = slog.LevelDebug
@@ -67,11 +117,92 @@ func run(ctx context.Context) error {
 		}),
 	)
 
+	weekday, err := parseWeekday(weekStart)
+	if err != nil {
+		return err
+	}
+	periodRules.WeekStart = weekday
+
+	if _, err := query.EscapedStatus(status); err != nil {
+		return fmt.Errorf("invalid --estimate-status: %w", err)
+	}
+
+	offsets := popular.NewOffsetTable()
+	if offsetsFile != "" {
+		offsets, err = popular.LoadOffsetTable(offsetsFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	client := hypnohub.FromHTTPClient(loggedHTTPClient)
-	updater := popular.NewPopularQueryUpdater(client)
+	updaterOpts := popular.PopularQueryUpdaterOptions{
+		Rules:          &periodRules,
+		Offsets:        offsets,
+		RefreshTimeout: refreshTime,
+		Status:         status,
+	}
+	if interpolate || anchorsFile != "" {
+		// Anchors are only searched from by interpolation, so recording them
+		// for binary search would not save any searches after a restart.
+		updaterOpts.Method = popular.InterpolationMethod
+	}
+	if anchorsFile != "" {
+		anchors, err := popular.LoadAnchorStore(anchorsFile)
+		if err != nil {
+			return err
+		}
+		updaterOpts.Anchors = anchors
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			saveAnchorsPeriodically(ctx, anchors, logger)
+		}()
+	}
+
+	if stateFile != "" {
+		updaterOpts.Store = popular.NewFilePopularQueryStore(stateFile)
+	}
+
+	var trending *popular.TrendingTracker
+	if trendingOn {
+		// The tracker is only started by the first request for trending
+		// posts, so that it doesn't poll hypnohub for nobody.
+		trending = popular.NewTrendingTracker(client, popular.TrendingOptions{})
+	}
+
+	updater := popular.NewPopularQueryUpdaterWithOptions(client, updaterOpts)
+	if err := updater.Restore(); err != nil {
+		logger.Warn("cannot restore popular queries", "err", err)
+	}
+	go updater.Run(ctx)
+
+	var archive *popular.Archive
+	var archiver *popular.Archiver
+	var archiveLoc *time.Location
+	if archiveDir != "" {
+		archiveLoc, err = time.LoadLocation(archiveTZ)
+		if err != nil {
+			return fmt.Errorf("invalid archive timezone: %w", err)
+		}
+		archive, err = popular.OpenArchive(archiveDir)
+		if err != nil {
+			return err
+		}
+		archiver = popular.NewArchiver(client, archive, popular.ArchiverOptions{
+			Rules:    &periodRules,
+			Timezone: archiveLoc,
+			Offsets:  updaterOpts.Offsets,
+			Method:   updaterOpts.Method,
+			Anchors:  updaterOpts.Anchors,
+			Status:   updaterOpts.Status,
+		})
+		go archiver.Run(ctx)
+	}
 
 	r := chi.NewMux()
-	r.Route("/api/popular", func(r chi.Router) {
+	r.Route("/api", func(r chi.Router) {
 		r.Use(middleware.Recoverer)
 		r.Use(middleware.NoCache)
 		if verbose {
@@ -81,10 +212,20 @@ func run(ctx context.Context) error {
 			}))
 		}
 
-		r.Get("/daily", handlePopular(updater, popular.Daily))
-		r.Get("/daily-yesterday", handlePopular(updater, popular.DailyYesterday))
-		r.Get("/weekly", handlePopular(updater, popular.Weekly))
-		r.Get("/monthly", handlePopular(updater, popular.Monthly))
+		r.Get("/popular/{period}", handlePopular(updater))
+		r.Get("/popular/{period}/posts", handlePopularPosts(updater, newPostsCache(client)))
+		if trending != nil {
+			r.Get("/trending", handleTrending(ctx, trending))
+		}
+
+		if explain {
+			r.Get("/popular/{period}/explain", handleExplain(updater))
+		}
+
+		if archiver != nil {
+			r.Get("/popular/{period}/archive", handleArchiveDates(archive))
+			r.Get("/popular/{period}/{date}", handleArchived(archiver, archiveLoc))
+		}
 	})
 
 	r.Group(func(r chi.Router) {
@@ -103,20 +244,195 @@ func run(ctx context.Context) error {
 	return hserve.ListenAndServe(ctx, httpAddr, r)
 }
 
-func handlePopular(updater *popular.PopularQueryUpdater, period popular.TimePeriod) http.HandlerFunc {
+func handlePopular(updater *popular.PopularQueryUpdater) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Intentionally use the background context so that the query is never
-		// interrupted, otherwise the user can abuse the endpoint to spam
-		// the server with requests.
-		query, err := updater.QueryPopular(context.Background(), period)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		result, notice, ok := queryPopular(w, r, updater)
+		if !ok {
+			return
+		}
+
+		q := result.Query
+
+		// Tell the client how old the query is, since stale queries are
+		// served while they are being refreshed.
+		w.Header().Set("Age", strconv.Itoa(int(result.Age().Seconds())))
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, popularQueryResponse{
+				Query:     q.String(),
+				URL:       q.WebURL(),
+				Since:     result.Since,
+				UpdatedAt: result.UpdatedAt,
+				Stale:     result.Stale,
+				Timezone:  result.Since.Location().String(),
+				Notice:    notice,
+			})
 			return
 		}
 
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		io.WriteString(w, query.String())
+		io.WriteString(w, q.String())
+	}
+}
+
+// queryPopular queries the popular query for the request. If the requested
+// timezone cannot be cached right now, then the query in UTC is returned
+// instead, along with a notice saying so. If it fails, then an error is
+// written to w and false is returned.
+func queryPopular(w http.ResponseWriter, r *http.Request, updater *popular.PopularQueryUpdater) (result *popular.PopularQueryResult, notice string, ok bool) {
+	opts, err := parsePopularQueryOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	// The request only bounds how long it waits. The query itself is
+	// computed by the updater, which is never interrupted by the request,
+	// otherwise the user can abuse the endpoint to spam the server with
+	// requests.
+	ctx, cancel := context.WithTimeout(r.Context(), waitTimeout)
+	defer cancel()
+
+	result, err = updater.QueryPopularWith(ctx, opts)
+	if errors.Is(err, popular.ErrTooManyTimezones) {
+		notice = fmt.Sprintf("Too many timezones are in use right now, so %s is shown in UTC instead.", opts.Period)
+		opts.Timezone = nil
+		result, err = updater.QueryPopularWith(ctx, opts)
+	}
+	if err != nil {
+		writeUpstreamError(w, err)
+		return nil, "", false
+	}
+
+	if err := result.Query.CheckLimits(query.DefaultLimits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	return result, notice, true
+}
+
+// parsePopularQueryOptions parses the popular query options from the
+// request's {period} URL parameter and its query parameters. The ?q= query
+// parameter is the base query that the popular posts must match, and ?rating=
+// is the rating that they must have.
+func parsePopularQueryOptions(r *http.Request) (popular.PopularQueryOptions, error) {
+	var opts popular.PopularQueryOptions
+
+	period, err := popular.ParseTimePeriod(chi.URLParam(r, "period"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Period = period
+
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		// Don't let the caller pick the server's own timezone.
+		if tz == "Local" {
+			return opts, fmt.Errorf("unknown timezone %q", tz)
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return opts, fmt.Errorf("unknown timezone %q", tz)
+		}
+		opts.Timezone = loc
+	}
+
+	if q := r.URL.Query().Get("q"); q != "" {
+		base, err := query.Parse(q)
+		if err != nil {
+			return opts, fmt.Errorf("invalid query: %w", err)
+		}
+		// The popular query already sorts by score.
+		if slices.ContainsFunc(base, func(clause string) bool {
+			return strings.HasPrefix(clause, "sort:")
+		}) {
+			return opts, fmt.Errorf("invalid query: cannot sort popular posts")
+		}
+		opts.Base = base
+	}
+
+	if rating := hypnohub.Rating(r.URL.Query().Get("rating")); rating != "" {
+		if !rating.IsValid() {
+			return opts, fmt.Errorf("unknown rating %q", rating)
+		}
+		opts.Rating = rating
+	}
+
+	return opts, nil
+}
+
+type popularQueryResponse struct {
+	Query     string    `json:"query"`
+	URL       string    `json:"url"`
+	Since     time.Time `json:"since"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Stale     bool      `json:"stale"`
+	Timezone  string    `json:"timezone"`
+	Notice    string    `json:"notice,omitempty"` // why the result differs from the request
+}
+
+// writeUpstreamError writes an error that happened while waiting for
+// Hypnohub. Timeouts are reported as 503 Service Unavailable with a
+// Retry-After header, since the work carries on in the background, and so
+// is a full posts cache. Requests for too many timezones are reported as 429
+// Too Many Requests.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	if errors.Is(err, popular.ErrTooManyTimezones) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(popular.DefaultTimezoneEvictionInterval.Seconds())))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, popular.ErrCacheFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, popular.ErrRefreshTimeout) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		http.Error(w, "timed out waiting for hypnohub, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to write JSON response", "err", err)
+	}
+}
+
+// saveAnchorsPeriodically saves the anchor store every few minutes until the
+// context is done, after which it saves one last time.
+func saveAnchorsPeriodically(ctx context.Context, anchors *popular.AnchorStore, logger *slog.Logger) {
+	save := func() {
+		if err := anchors.Save(); err != nil {
+			logger.Error("cannot save anchors", "err", err)
+		}
+	}
+	defer save()
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			save()
+		}
+	}
+}
+
+// parseWeekday parses a weekday from its English name, such as "monday".
+func parseWeekday(name string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), name) {
+			return d, nil
+		}
 	}
+	return 0, fmt.Errorf("unknown weekday %q", name)
 }
 
 // hashFS returns a hash of the given filesystem.
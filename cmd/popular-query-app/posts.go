@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/popular"
+)
+
+const (
+	// maxPostsPage is the maximum page that can be requested from the popular
+	// posts endpoint.
+	maxPostsPage = 50
+	// maxCachedPostsPages is the maximum number of pages that the posts cache
+	// keeps, including the ones still being fetched.
+	maxCachedPostsPages = 256
+	// postsCacheTTL is how long the posts cache keeps a page. Scores change
+	// over time, and the queries of AllTime never change, so pages have to
+	// expire on their own.
+	postsCacheTTL = 10 * time.Minute
+	// postsFetchTimeout is the maximum time spent fetching a single page.
+	postsFetchTimeout = time.Minute
+	// defaultTrendingLimit and maxTrendingLimit are the default and maximum
+	// number of posts returned by the trending endpoint.
+	defaultTrendingLimit = 50
+	maxTrendingLimit     = 500
+)
+
+// newPostsCache creates the cache of the pages served by handlePopularPosts.
+func newPostsCache(searcher popular.PostsSearcher) *popular.CachingSearcher {
+	return popular.NewCachingSearcher(searcher, popular.CacheOptions{
+		TTL:        postsCacheTTL,
+		MaxEntries: maxCachedPostsPages,
+		Timeout:    postsFetchTimeout,
+	})
+}
+
+func handlePopularPosts(updater *popular.PopularQueryUpdater, cache *popular.CachingSearcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		if v := r.URL.Query().Get("page"); v != "" {
+			p, err := strconv.Atoi(v)
+			if err != nil || p < 0 || p > maxPostsPage {
+				http.Error(w, fmt.Sprintf("invalid page %q", v), http.StatusBadRequest)
+				return
+			}
+			page = p
+		}
+
+		result, _, ok := queryPopular(w, r, updater)
+		if !ok {
+			return
+		}
+
+		q := result.Query.String()
+
+		ctx, cancel := context.WithTimeout(r.Context(), waitTimeout)
+		defer cancel()
+
+		// The search carries on if the request gives up, so that the page is
+		// still cached for later requests.
+		found, err := cache.SearchPosts(ctx, q, page*hypnohub.PostsPerPage)
+		if err != nil {
+			writeUpstreamError(w, fmt.Errorf("searching posts: %w", err))
+			return
+		}
+		posts := found.Posts
+
+		resp := popularPostsResponse{
+			Query: q,
+			Page:  page,
+			Posts: make([]popularPost, len(posts)),
+			// A full page means that there may be more posts.
+			HasMore: len(posts) >= hypnohub.PostsPerPage && page < maxPostsPage,
+		}
+		for i, post := range posts {
+			resp.Posts[i] = newPopularPost(post)
+		}
+
+		writeJSON(w, resp)
+	}
+}
+
+// handleTrending serves the trending posts. The tracker is started using ctx
+// on the first request.
+func handleTrending(ctx context.Context, tracker *popular.TrendingTracker) http.HandlerFunc {
+	var start sync.Once
+	return func(w http.ResponseWriter, r *http.Request) {
+		start.Do(func() { go tracker.Run(ctx) })
+
+		limit := defaultTrendingLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > maxTrendingLimit {
+				http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+
+		posts, snapshotAt := tracker.Trending(limit)
+		if snapshotAt.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			http.Error(w, "trending posts are not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		resp := trendingResponse{
+			SnapshotAt: snapshotAt,
+			Posts:      make([]trendingPost, len(posts)),
+		}
+		for i, post := range posts {
+			resp.Posts[i] = trendingPost{
+				popularPost:  newPopularPost(post.Post),
+				ScorePerHour: post.ScorePerHour,
+			}
+		}
+
+		writeJSON(w, resp)
+	}
+}
+
+type trendingResponse struct {
+	SnapshotAt time.Time      `json:"snapshot_at"`
+	Posts      []trendingPost `json:"posts"`
+}
+
+type trendingPost struct {
+	popularPost
+	ScorePerHour float64 `json:"score_per_hour"`
+}
+
+type popularPostsResponse struct {
+	Query   string        `json:"query"`
+	Page    int           `json:"page"`
+	Posts   []popularPost `json:"posts"`
+	HasMore bool          `json:"has_more"`
+}
+
+type popularPost struct {
+	ID            hypnohub.PostID `json:"id"`
+	URL           string          `json:"url"`
+	PreviewURL    string          `json:"preview_url"`
+	PreviewWidth  int             `json:"preview_width"`
+	PreviewHeight int             `json:"preview_height"`
+	SampleURL     string          `json:"sample_url"`
+	FileURL       string          `json:"file_url"`
+	Score         int             `json:"score"`
+	Rating        hypnohub.Rating `json:"rating"`
+	Tags          []string        `json:"tags"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+func newPopularPost(post hypnohub.Post) popularPost {
+	return popularPost{
+		ID:            post.ID,
+		URL:           post.WebURL(),
+		PreviewURL:    post.PreviewURL,
+		PreviewWidth:  post.PreviewWidth,
+		PreviewHeight: post.PreviewHeight,
+		SampleURL:     post.SampleURL,
+		FileURL:       post.FileURL,
+		Score:         post.Score,
+		Rating:        post.Rating,
+		Tags:          post.Tags.Split(),
+		CreatedAt:     post.CreatedAt.Time(),
+	}
+}
@@ -60,6 +60,16 @@ type Post struct {
 	HasChildren   bool     `xml:"has_children,attr" json:"has_children"`
 }
 
+// WebURL returns the URL of the post's Hypnohub web page.
+func (p Post) WebURL() string {
+	v := url.Values{
+		"page": {"post"},
+		"s":    {"view"},
+		"id":   {strconv.Itoa(int(p.ID))},
+	}
+	return BaseURL + "?" + v.Encode()
+}
+
 // Date is a date from the hypnohub API.
 type Date time.Time
 
@@ -86,6 +96,16 @@ const (
 	RatingExplicit     Rating = "explicit"
 )
 
+// IsValid returns whether the rating is one of the known ratings.
+func (r Rating) IsValid() bool {
+	switch r {
+	case RatingSafe, RatingQuestionable, RatingExplicit:
+		return true
+	default:
+		return false
+	}
+}
+
 // TagsList is a list of tags from the hypnohub API. It is a space-separated
 // list of tags.
 type TagsList string
@@ -118,6 +138,10 @@ const (
 	TagTypeMeta      TagType = 5
 )
 
+// BaseURL is the URL of Hypnohub's index page, which serves both the API and
+// the web pages.
+const BaseURL = "https://hypnohub.net/index.php"
+
 // Client is a Hypnohub client.
 type Client struct {
 	HTTPClient *http.Client
@@ -137,6 +161,10 @@ func FromHTTPClient(c *http.Client) *Client {
 	}
 }
 
+// PostsPerPage is the number of posts that [Client.SearchPosts] returns per
+// page.
+const PostsPerPage = 100
+
 // SearchPostsResult is the result of a search for posts on Hypnohub.
 type SearchPostsResult struct {
 	Posts  []Post `json:"posts"`
@@ -153,7 +181,7 @@ func (d *Client) SearchPosts(ctx context.Context, query string, postOffset int)
 		"tags": {query},
 		"pid":  {strconv.Itoa(int(postOffset))},
 	}
-	url := "https://hypnohub.net/index.php?" + q.Encode()
+	url := BaseURL + "?" + q.Encode()
 
 	type Response struct {
 		XMLName xml.Name `xml:"posts"`
@@ -191,7 +219,7 @@ func (d *Client) SearchTags(ctx context.Context, query string, afterID int) (*Se
 	if afterID != 0 {
 		q["after_id"] = []string{strconv.Itoa(afterID)}
 	}
-	url := "https://hypnohub.net/index.php?" + q.Encode()
+	url := BaseURL + "?" + q.Encode()
 
 	type tagResponse struct {
 		XMLName xml.Name `xml:"tags"`
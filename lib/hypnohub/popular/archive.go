@@ -0,0 +1,414 @@
+package popular
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/query"
+)
+
+// ArchiveDateFormat is the format of the dates that identify archived time
+// periods.
+const ArchiveDateFormat = "2006-01-02"
+
+// DefaultArchiveTopN is the default number of posts that an [Archiver] keeps
+// for each time period.
+const DefaultArchiveTopN = 100
+
+const (
+	// DefaultArchiveBackfill is the default number of recently ended time
+	// periods that an [Archiver] archives if they are missing.
+	DefaultArchiveBackfill = 3
+	// DefaultArchiveRetryInterval is the default time that an [Archiver]
+	// waits before retrying time periods that failed to be archived. It
+	// doubles after every failed retry, up to maxArchiveRetryInterval.
+	DefaultArchiveRetryInterval = 5 * time.Minute
+
+	maxArchiveRetryInterval = time.Hour
+)
+
+// ErrNotArchivable is returned for time periods that cannot be archived, which
+// are the ones that are not in [ArchivablePeriods].
+var ErrNotArchivable = errors.New("time period cannot be archived")
+
+// ArchivablePeriods are the time periods that can be archived. They are the
+// ones that have a calendar range, see [PeriodRules.CalendarRange].
+var ArchivablePeriods = []TimePeriod{Daily, Weekly, Monthly, Yearly}
+
+// ArchivedPeriod is the leaderboard of a time period that has ended.
+type ArchivedPeriod struct {
+	// Period is the archived time period.
+	Period TimePeriod `json:"period"`
+	// Date is the first day of the time period, formatted using
+	// [ArchiveDateFormat].
+	Date string `json:"date"`
+	// From and To are the start (inclusive) and end (exclusive) of the time
+	// period.
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Query is the query that lists the posts in the time period.
+	Query query.Query `json:"query"`
+	// ArchivedAt is the time that the time period was archived at.
+	ArchivedAt time.Time `json:"archived_at"`
+	// Posts are the top posts in the time period, sorted by descending score.
+	Posts []ArchivedPost `json:"posts"`
+}
+
+// ArchivedPost is a post in an [ArchivedPeriod].
+type ArchivedPost struct {
+	ID         hypnohub.PostID `json:"id"`
+	Score      int             `json:"score"`
+	Rating     hypnohub.Rating `json:"rating"`
+	Tags       []string        `json:"tags"`
+	PreviewURL string          `json:"preview_url,omitempty"`
+}
+
+// Archive stores archived time periods as JSON files in a directory. Each
+// file is named after the time period and its date, such as
+// daily/2024-01-05.json.
+type Archive struct {
+	dir string
+}
+
+// OpenArchive opens the archive in the given directory, creating the
+// directory if needed.
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archive{dir: dir}, nil
+}
+
+func (a *Archive) path(period TimePeriod, date string) string {
+	return filepath.Join(a.dir, period.String(), date+".json")
+}
+
+// Load loads the archived time period with the given date. If it has not been
+// archived, then an error wrapping [fs.ErrNotExist] is returned.
+func (a *Archive) Load(period TimePeriod, date string) (*ArchivedPeriod, error) {
+	if _, err := time.Parse(ArchiveDateFormat, date); err != nil {
+		return nil, fmt.Errorf("invalid date %q: %w", date, err)
+	}
+
+	b, err := os.ReadFile(a.path(period, date))
+	if err != nil {
+		return nil, err
+	}
+
+	var archived ArchivedPeriod
+	if err := json.Unmarshal(b, &archived); err != nil {
+		return nil, fmt.Errorf("parsing archived %v %s: %w", period, date, err)
+	}
+	return &archived, nil
+}
+
+// Save saves the archived time period, replacing any existing one.
+func (a *Archive) Save(archived *ArchivedPeriod) error {
+	path := a.path(archived.Period, archived.Date)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(archived)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// Has returns whether the time period with the given date has been archived.
+func (a *Archive) Has(period TimePeriod, date string) bool {
+	_, err := os.Stat(a.path(period, date))
+	return err == nil
+}
+
+// Dates returns the dates of the archived time periods, oldest first.
+func (a *Archive) Dates(period TimePeriod) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(a.dir, period.String()))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var dates []string
+	for _, entry := range entries {
+		date, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(ArchiveDateFormat, date); err != nil {
+			continue
+		}
+		dates = append(dates, date)
+	}
+
+	slices.Sort(dates)
+	return dates, nil
+}
+
+// ArchiverOptions are options for an [Archiver].
+type ArchiverOptions struct {
+	// Rules are the rules that decide when each week starts. If nil, then
+	// [DefaultPeriodRules] is used.
+	Rules *PeriodRules
+	// Timezone is the timezone that days start in. If nil, then [time.UTC]
+	// is used.
+	Timezone *time.Location
+	// TopN is the number of posts to keep for each time period. If 0, then
+	// [DefaultArchiveTopN] is used.
+	TopN int
+	// Periods are the time periods to archive. If nil, then
+	// [ArchivablePeriods] is used.
+	Periods []TimePeriod
+	// Offsets is the table of maximum offsets to search. If nil, then a new
+	// in-memory table is used.
+	Offsets *OffsetTable
+	// Method is the method used to estimate each time period's posts. If
+	// zero, then [BinarySearchMethod] is used.
+	Method EstimateMethod
+	// Anchors, if not nil, is used when estimating each time period's posts.
+	Anchors *AnchorStore
+	// Status, if not empty, only searches posts with the given status while
+	// estimating. See [EstimatePostOptions.Status].
+	Status string
+	// Backfill is the number of most recently ended time periods of each
+	// kind that are archived if they are missing, such as after a failure or
+	// while the archiver was not running. If 0, then
+	// [DefaultArchiveBackfill] is used.
+	Backfill int
+	// RetryInterval is how long to wait before retrying time periods that
+	// failed to be archived. If 0, then [DefaultArchiveRetryInterval] is
+	// used.
+	RetryInterval time.Duration
+}
+
+// Archiver archives the top posts of each time period once it ends.
+type Archiver struct {
+	searcher PostsSearcher
+	archive  *Archive
+	opts     ArchiverOptions
+	now      func() time.Time
+}
+
+// NewArchiver creates a new Archiver that saves to the given archive.
+func NewArchiver(searcher PostsSearcher, archive *Archive, opts ArchiverOptions) *Archiver {
+	if opts.Rules == nil {
+		rules := DefaultPeriodRules
+		opts.Rules = &rules
+	}
+	if opts.Timezone == nil {
+		opts.Timezone = time.UTC
+	}
+	if opts.TopN == 0 {
+		opts.TopN = DefaultArchiveTopN
+	}
+	if opts.Periods == nil {
+		opts.Periods = ArchivablePeriods
+	}
+	if opts.Offsets == nil {
+		opts.Offsets = NewOffsetTable()
+	}
+	if opts.Backfill == 0 {
+		opts.Backfill = DefaultArchiveBackfill
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = DefaultArchiveRetryInterval
+	}
+	return &Archiver{
+		searcher: searcher,
+		archive:  archive,
+		opts:     opts,
+		now:      time.Now,
+	}
+}
+
+// Lookup loads the archived time period that contains the given date. The
+// date is interpreted in the archiver's timezone.
+func (a *Archiver) Lookup(period TimePeriod, date time.Time) (*ArchivedPeriod, error) {
+	r, ok := a.calendarRange(date, period)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotArchivable, period)
+	}
+	return a.archive.Load(period, r.From.Format(ArchiveDateFormat))
+}
+
+// Run archives each time period once it ends until the context is done. The
+// most recently ended time periods that are missing, such as ones that ended
+// while the archiver was not running, are archived as well, see
+// [ArchiverOptions.Backfill]. Time periods that fail to be archived are
+// retried with a backoff. Errors are logged.
+//
+// If none of the archiver's time periods can be archived, then Run returns
+// immediately.
+func (a *Archiver) Run(ctx context.Context) {
+	retry := a.opts.RetryInterval
+
+	for {
+		next, failed := a.archiveEnded(ctx)
+		if next.IsZero() {
+			slog.Warn(
+				"no time periods to archive",
+				"periods", a.opts.Periods)
+			return
+		}
+
+		if failed {
+			next = minTime(next, a.now().Add(retry))
+			retry = min(retry*2, maxArchiveRetryInterval)
+		} else {
+			retry = a.opts.RetryInterval
+		}
+
+		timer := time.NewTimer(next.Sub(a.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// archiveEnded archives the most recently ended time periods that are not
+// archived yet. It returns the time that the next time period ends at, which
+// is zero if there are no time periods to archive, and whether any time
+// period failed to be archived.
+func (a *Archiver) archiveEnded(ctx context.Context) (next time.Time, failed bool) {
+	now := a.now().In(a.opts.Timezone)
+
+	// Time periods that end together search for the same boundaries, so
+	// they share the pages fetched during this pass like [EstimatePostBatch].
+	memo := NewCachingSearcher(a.searcher, CacheOptions{
+		MaxEntries: math.MaxInt,
+		KeepCancel: true,
+	})
+
+	for _, period := range a.opts.Periods {
+		current, ok := a.calendarRange(now, period)
+		if !ok {
+			continue
+		}
+		if next.IsZero() || current.To.Before(next) {
+			next = current.To
+		}
+
+		// Each previous time period ended just before the next one.
+		r := current
+		for i := 0; i < a.opts.Backfill; i++ {
+			r, _ = a.calendarRange(r.From.Add(-time.Nanosecond), period)
+			if a.archive.Has(period, r.From.Format(ArchiveDateFormat)) {
+				continue
+			}
+
+			if _, err := a.archivePeriod(ctx, memo, period, r.From); err != nil {
+				failed = true
+				slog.Warn(
+					"cannot archive popular posts",
+					"period", period,
+					"from", r.From,
+					"err", err)
+			}
+		}
+	}
+
+	return next, failed
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// ArchivePeriod archives the time period that contains the given date, which
+// must have ended.
+func (a *Archiver) ArchivePeriod(ctx context.Context, period TimePeriod, date time.Time) (*ArchivedPeriod, error) {
+	return a.archivePeriod(ctx, a.searcher, period, date)
+}
+
+func (a *Archiver) archivePeriod(ctx context.Context, searcher PostsSearcher, period TimePeriod, date time.Time) (*ArchivedPeriod, error) {
+	now := a.now().In(a.opts.Timezone)
+
+	r, ok := a.calendarRange(date, period)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotArchivable, period)
+	}
+	if r.To.After(now) {
+		return nil, fmt.Errorf("%v %s has not ended yet", period, r.From.Format(ArchiveDateFormat))
+	}
+
+	ids, err := EstimatePostRange(ctx, searcher, EstimatePostOptions{
+		Now:      now,
+		Timezone: a.opts.Timezone,
+		Range:    r,
+		Offsets:  a.opts.Offsets,
+		Method:   a.opts.Method,
+		Anchors:  a.opts.Anchors,
+		Status:   a.opts.Status,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("estimating posts: %w", err)
+	}
+
+	q := query.And(
+		query.Sort(query.SortScore, query.SortDescending),
+		ids.Query(),
+	)
+
+	archived := &ArchivedPeriod{
+		Period:     period,
+		Date:       r.From.Format(ArchiveDateFormat),
+		From:       r.From,
+		To:         r.To,
+		Query:      q,
+		ArchivedAt: now,
+		Posts:      []ArchivedPost{},
+	}
+
+	for len(archived.Posts) < a.opts.TopN {
+		result, err := searcher.SearchPosts(ctx, q.String(), len(archived.Posts))
+		if err != nil {
+			return nil, fmt.Errorf("searching posts: %w", err)
+		}
+		if len(result.Posts) == 0 {
+			break
+		}
+		for _, post := range result.Posts {
+			archived.Posts = append(archived.Posts, ArchivedPost{
+				ID:         post.ID,
+				Score:      post.Score,
+				Rating:     post.Rating,
+				Tags:       post.Tags.Split(),
+				PreviewURL: post.PreviewURL,
+			})
+		}
+	}
+
+	if len(archived.Posts) > a.opts.TopN {
+		archived.Posts = archived.Posts[:a.opts.TopN]
+	}
+
+	if err := a.archive.Save(archived); err != nil {
+		return nil, fmt.Errorf("saving archive: %w", err)
+	}
+
+	return archived, nil
+}
+
+func (a *Archiver) calendarRange(t time.Time, period TimePeriod) (TimeRange, bool) {
+	return a.opts.Rules.CalendarRange(t.In(a.opts.Timezone), period)
+}
@@ -0,0 +1,148 @@
+package popular
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+func TestArchiver(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2024, time.January, d, h, 0, 0, 0, time.UTC)
+	}
+
+	searcher := newPostsSearcher([]mockPost{
+		{8, day(6, 1)},
+		{7, day(5, 20)},
+		{6, day(5, 9)},
+		{5, day(5, 0)},
+		{4, day(4, 23)},
+		{3, day(4, 12)},
+		{2, day(3, 5)},
+		{1, day(2, 5)},
+	})
+
+	archive, err := OpenArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archiver := NewArchiver(searcher, archive, ArchiverOptions{
+		Periods:  []TimePeriod{Daily},
+		Method:   InterpolationMethod,
+		Backfill: 2,
+	})
+	archiver.now = func() time.Time { return day(6, 2) }
+
+	next, failed := archiver.archiveEnded(context.Background())
+	if !next.Equal(day(7, 0)) {
+		t.Errorf("expected next boundary at %v, got %v", day(7, 0), next)
+	}
+	if failed {
+		t.Errorf("expected no failures")
+	}
+
+	archived, err := archiver.Lookup(Daily, day(5, 12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived.Date != "2024-01-05" {
+		t.Errorf("expected date 2024-01-05, got %s", archived.Date)
+	}
+
+	var ids []hypnohub.PostID
+	for _, post := range archived.Posts {
+		ids = append(ids, post.ID)
+	}
+	if expect := []hypnohub.PostID{7, 6, 5}; !slices.Equal(ids, expect) {
+		t.Errorf("expected posts %v, got %v", expect, ids)
+	}
+
+	if _, err := archiver.Lookup(Daily, day(3, 12)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected day before the back-fill to not be archived, got %v", err)
+	}
+	if _, err := archiver.Lookup(AllTime, day(3, 12)); !errors.Is(err, ErrNotArchivable) {
+		t.Errorf("expected all-time to not be archivable, got %v", err)
+	}
+
+	if _, err := archiver.ArchivePeriod(context.Background(), Daily, day(6, 0)); err == nil {
+		t.Errorf("expected archiving the current day to fail")
+	}
+
+	dates, err := archive.Dates(Daily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(dates, []string{"2024-01-04", "2024-01-05"}) {
+		t.Errorf("unexpected archived dates %v", dates)
+	}
+}
+
+func TestArchiverRetry(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2024, time.January, d, h, 0, 0, 0, time.UTC)
+	}
+
+	var down atomic.Bool
+	down.Store(true)
+
+	searcher := NewFaultySearcher(newPostsSearcher([]mockPost{
+		{3, day(6, 1)},
+		{2, day(5, 9)},
+		{1, day(4, 9)},
+	}), FaultOptions{
+		Match: func(string, int) bool { return down.Load() },
+	})
+
+	archive, err := OpenArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archiver := NewArchiver(searcher, archive, ArchiverOptions{
+		Periods:  []TimePeriod{Daily},
+		Backfill: 2,
+	})
+	archiver.now = func() time.Time { return day(6, 2) }
+
+	if _, failed := archiver.archiveEnded(context.Background()); !failed {
+		t.Fatal("expected archiving to fail while the searcher is down")
+	}
+
+	// The day that failed is archived once the searcher is back, even if
+	// it's already the next day.
+	down.Store(false)
+	archiver.now = func() time.Time { return day(7, 3) }
+
+	if _, failed := archiver.archiveEnded(context.Background()); failed {
+		t.Fatal("expected archiving to succeed")
+	}
+	if _, err := archiver.Lookup(Daily, day(5, 0)); err != nil {
+		t.Errorf("expected failed day to be archived on retry, got %v", err)
+	}
+}
+
+func TestArchiverNoPeriods(t *testing.T) {
+	archive, err := OpenArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archiver := NewArchiver(newPostsSearcher(nil), archive, ArchiverOptions{
+		Periods: []TimePeriod{AllTime},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	archiver.Run(ctx)
+	if ctx.Err() != nil {
+		t.Error("expected Run to return without any time periods to archive")
+	}
+}
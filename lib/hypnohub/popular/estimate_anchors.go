@@ -0,0 +1,202 @@
+package popular
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+// DefaultMaxAnchors is the default maximum number of anchors that an
+// [AnchorStore] keeps.
+const DefaultMaxAnchors = 4096
+
+// AnchorStore records which post IDs were created at which times, so that
+// [InterpolationMethod] can start its search from the nearest known posts
+// instead of from the newest and oldest posts. It is safe to use from
+// multiple goroutines.
+type AnchorStore struct {
+	// MaxAnchors is the maximum number of anchors to keep. When there are
+	// more, every other anchor is dropped. If 0, then [DefaultMaxAnchors] is
+	// used.
+	MaxAnchors int
+
+	mu      sync.Mutex
+	anchors []anchor // sorted by ID
+	path    string
+	dirty   bool
+}
+
+// NewAnchorStore creates a new in-memory AnchorStore.
+func NewAnchorStore() *AnchorStore {
+	return &AnchorStore{}
+}
+
+// LoadAnchorStore loads an AnchorStore from the given JSON file. If the file
+// does not exist, then an empty store is returned. Call [AnchorStore.Save] to
+// write the store back to the file.
+func LoadAnchorStore(path string) (*AnchorStore, error) {
+	s := &AnchorStore{path: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &s.anchors); err != nil {
+		return nil, fmt.Errorf("parsing anchor store %s: %w", path, err)
+	}
+	slices.SortFunc(s.anchors, compareAnchors)
+	s.anchors = slices.CompactFunc(s.anchors, sameAnchorID)
+
+	return s, nil
+}
+
+// clone returns an in-memory copy of the store.
+func (s *AnchorStore) clone() *AnchorStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &AnchorStore{
+		MaxAnchors: s.MaxAnchors,
+		anchors:    slices.Clone(s.anchors),
+	}
+}
+
+// Save writes the store to the file that it was loaded from. It does nothing
+// if the store was not loaded from a file or if nothing has changed since the
+// last save.
+func (s *AnchorStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(s.anchors)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// Len returns the number of anchors in the store.
+func (s *AnchorStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.anchors)
+}
+
+// Observe records anchors from the given posts. Only the first and last posts
+// are recorded, since the posts in between add little information.
+func (s *AnchorStore) Observe(posts []hypnohub.Post) {
+	if len(posts) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(postAnchor(posts[0]))
+	if len(posts) > 1 {
+		s.add(postAnchor(posts[len(posts)-1]))
+	}
+
+	maxAnchors := s.MaxAnchors
+	if maxAnchors <= 0 {
+		maxAnchors = DefaultMaxAnchors
+	}
+	if len(s.anchors) > maxAnchors {
+		s.anchors = thinAnchors(s.anchors)
+	}
+}
+
+func (s *AnchorStore) add(a anchor) {
+	if a.CreatedAt.IsZero() || !a.ID.IsValid() {
+		return
+	}
+	i, found := slices.BinarySearchFunc(s.anchors, a, compareAnchors)
+	if found {
+		if s.anchors[i].CreatedAt.Equal(a.CreatedAt) {
+			return
+		}
+		s.anchors[i] = a
+	} else {
+		s.anchors = slices.Insert(s.anchors, i, a)
+	}
+	s.dirty = true
+}
+
+// nearest returns the anchors closest to the threshold: lo is the newest
+// anchor created before the threshold, and hi is the oldest anchor created at
+// or after it. Either may be missing.
+func (s *AnchorStore) nearest(threshold time.Time) (lo, hi anchor, hasLo, hasHi bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.anchors), func(i int) bool {
+		return !s.anchors[i].CreatedAt.Before(threshold)
+	})
+	if i > 0 {
+		lo, hasLo = s.anchors[i-1], true
+	}
+	if i < len(s.anchors) {
+		hi, hasHi = s.anchors[i], true
+	}
+	return
+}
+
+// Searcher returns a PostsSearcher that records anchors from the results of
+// every search made using the given searcher.
+func (s *AnchorStore) Searcher(searcher PostsSearcher) PostsSearcher {
+	return anchorRecorder{searcher, s}
+}
+
+type anchorRecorder struct {
+	PostsSearcher
+	store *AnchorStore
+}
+
+func (r anchorRecorder) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	result, err := r.PostsSearcher.SearchPosts(ctx, query, postOffset)
+	if err == nil {
+		r.store.Observe(result.Posts)
+	}
+	return result, err
+}
+
+// thinAnchors drops every other anchor, keeping the oldest and newest ones.
+func thinAnchors(anchors []anchor) []anchor {
+	thinned := anchors[:0]
+	for i, a := range anchors {
+		if i%2 == 0 || i == len(anchors)-1 {
+			thinned = append(thinned, a)
+		}
+	}
+	return thinned
+}
+
+func compareAnchors(a, b anchor) int {
+	return cmp.Compare(a.ID, b.ID)
+}
+
+func sameAnchorID(a, b anchor) bool {
+	return a.ID == b.ID
+}
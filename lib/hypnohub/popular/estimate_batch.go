@@ -0,0 +1,81 @@
+package popular
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+// DefaultMaxParallelProbes is the default maximum number of searches that
+// [EstimatePostBatch] makes at the same time.
+const DefaultMaxParallelProbes = 4
+
+// BatchEstimateOptions are options for [EstimatePostBatch].
+type BatchEstimateOptions struct {
+	// EstimatePostOptions are the options shared by every time period.
+	// Period and Range are ignored.
+	EstimatePostOptions
+	// Periods are the time periods to estimate.
+	Periods []TimePeriod
+	// MaxParallel is the maximum number of searches to make at the same time.
+	// If 0, then [DefaultMaxParallelProbes] is used.
+	MaxParallel int
+}
+
+// EstimatePostBatch estimates the earliest post of several time periods at
+// once, like calling [EstimatePostHistory] for each of them. The estimates
+// run concurrently and share the pages that they fetch, so pages that
+// several estimates need are only fetched once.
+func EstimatePostBatch(ctx context.Context, searcher PostsSearcher, opts BatchEstimateOptions) (map[TimePeriod]hypnohub.PostID, error) {
+	maxParallel := opts.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = DefaultMaxParallelProbes
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The cache is only used by this batch, so it keeps every page, and its
+	// searches stop along with the batch.
+	memo := NewCachingSearcher(searcher, CacheOptions{
+		MaxEntries:  math.MaxInt,
+		MaxParallel: maxParallel,
+		KeepCancel:  true,
+	})
+
+	ids := make([]hypnohub.PostID, len(opts.Periods))
+	errs := make([]error, len(opts.Periods))
+
+	var wg sync.WaitGroup
+	for i, period := range opts.Periods {
+		wg.Add(1)
+		go func(i int, period TimePeriod) {
+			defer wg.Done()
+
+			o := opts.EstimatePostOptions
+			o.Period = period
+			o.Range = TimeRange{}
+
+			ids[i], errs[i] = EstimatePostHistory(ctx, memo, o)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("estimating %v: %w", period, errs[i])
+				cancel()
+			}
+		}(i, period)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	boundaries := make(map[TimePeriod]hypnohub.PostID, len(opts.Periods))
+	for i, period := range opts.Periods {
+		boundaries[period] = ids[i]
+	}
+	return boundaries, nil
+}
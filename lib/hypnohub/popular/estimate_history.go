@@ -4,10 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sort"
+	"slices"
 	"time"
 
 	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/query"
 )
 
 // TimePeriod is the maximum time period to estimate the post
@@ -19,18 +20,84 @@ const (
 	Weekly
 	Monthly
 	DailyYesterday
+	Yearly
+	AllTime
+	Last24Hours
+	Last7Days
+	Last30Days
 
 	maxTimePeriod
 )
 
+var timePeriodNames = [maxTimePeriod]string{
+	Daily:          "daily",
+	Weekly:         "weekly",
+	Monthly:        "monthly",
+	DailyYesterday: "daily-yesterday",
+	Yearly:         "yearly",
+	AllTime:        "all-time",
+	Last24Hours:    "last-24-hours",
+	Last7Days:      "last-7-days",
+	Last30Days:     "last-30-days",
+}
+
+// ParseTimePeriod parses a time period from its name, as returned by
+// [TimePeriod.String].
+func ParseTimePeriod(name string) (TimePeriod, error) {
+	for i, n := range timePeriodNames {
+		if n == name {
+			return TimePeriod(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown time period %q", name)
+}
+
+// IsValid returns whether the time period is one of the known time periods.
+func (e TimePeriod) IsValid() bool {
+	return e >= 0 && e < maxTimePeriod
+}
+
+// String returns the name of the time period, such as "daily" or
+// "last-7-days".
+func (e TimePeriod) String() string {
+	if !e.IsValid() {
+		return fmt.Sprintf("TimePeriod(%d)", int(e))
+	}
+	return timePeriodNames[e]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (e TimePeriod) MarshalText() ([]byte, error) {
+	if !e.IsValid() {
+		return nil, fmt.Errorf("invalid time period %d", int(e))
+	}
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (e *TimePeriod) UnmarshalText(text []byte) error {
+	p, err := ParseTimePeriod(string(text))
+	if err != nil {
+		return err
+	}
+	*e = p
+	return nil
+}
+
 // EstimatePostMaxOffsets hard codes the post offsets for each time period.
 // This offset is dependent on how active the site is, so it is not guaranteed
 // to be accurate. Because of this, it is overestimated to be safe.
+//
+// [AllTime] has no offset, since it always starts from the first post.
 var EstimatePostMaxOffsets = map[TimePeriod]int{
+	Yearly:         40000,
 	Monthly:        3000,
 	Weekly:         800,
 	Daily:          200,
 	DailyYesterday: 400,
+	Last30Days:     3000,
+	Last7Days:      800,
+	Last24Hours:    200,
 }
 
 // MaxOffset returns the maximum offset for the given time period.
@@ -57,15 +124,99 @@ type EstimatePostOptions struct {
 	Timezone *time.Location
 	// Period is the maximum time period to estimate the post history for.
 	Period TimePeriod
+	// Rules are the rules that decide when Period starts. If nil, then
+	// [DefaultPeriodRules] is used.
+	Rules *PeriodRules
+	// Offsets is the table of maximum offsets to search for each time period.
+	// If the maximum offset turns out to be too small, then the search bound
+	// is grown and the new offset is learned by the table. If nil, then
+	// [EstimatePostMaxOffsets] is used and nothing is learned.
+	Offsets *OffsetTable
+	// Range is an explicit time range to estimate the post history for. If
+	// Range.From is not zero, then it is used instead of Period.
+	Range TimeRange
 	// Accuracy is the accuracy of the estimate. If 0, then the estimate is
 	// as accurate as possible.
 	Accuracy time.Duration
+	// Method is the method used to search for the earliest post. If zero,
+	// then [BinarySearchMethod] is used.
+	Method EstimateMethod
+	// Anchors, if not nil, records the posts seen while estimating. With
+	// [InterpolationMethod], the search also starts from the nearest
+	// recorded posts.
+	Anchors *AnchorStore
+	// Trace, if not nil, records every search made while estimating.
+	Trace *EstimateTrace
+	// Status, if not empty, only searches posts with the given status, such
+	// as "active". Posts that are deleted or pending approval while
+	// estimating shift the offsets of every older post, so filtering by
+	// status keeps the offsets stable between searches. Statuses that cannot
+	// be escaped using [query.EscapeTag] are rejected.
+	Status string
+}
+
+// EstimateMethod is a method of searching for the earliest post in a time
+// period.
+type EstimateMethod int
+
+const (
+	// BinarySearchMethod binary searches over post offsets until it narrows
+	// the earliest post down to a page, then finds it within that page. It
+	// only needs to list posts.
+	BinarySearchMethod EstimateMethod = iota
+	// InterpolationMethod relies on post IDs being in creation order. It
+	// searches using ID filters, guessing the ID of the earliest post by
+	// interpolating between posts that it has already seen. It usually needs
+	// fewer requests than [BinarySearchMethod], and its result is exact.
+	InterpolationMethod
+)
+
+// TimeRange is a range of time from From (inclusive) to To (exclusive).
+type TimeRange struct {
+	From time.Time
+	// To is the end of the range. If zero, then the range has no end.
+	To time.Time
+}
+
+// PostIDRange is a range of post IDs from Lower (inclusive) to Upper
+// (exclusive).
+type PostIDRange struct {
+	Lower hypnohub.PostID
+	// Upper is the end of the range. If zero, then the range has no end.
+	Upper hypnohub.PostID
+}
+
+// Query returns the query that filters posts to within the range.
+func (r PostIDRange) Query() query.Query {
+	var q query.Query
+	if r.Lower.IsValid() {
+		q = query.And(q, query.ID(query.GreaterEqual, r.Lower))
+	}
+	if r.Upper.IsValid() {
+		q = query.And(q, query.ID(query.LessThan, r.Upper))
+	}
+	return q
 }
 
 // EstimatePostHistory estimates the post history for the given client.
 // It employs a semi-binary search to find the earliest post for each time
-// period.
+// period. It returns the lower bound of [EstimatePostRange].
 func EstimatePostHistory(ctx context.Context, searcher PostsSearcher, opts EstimatePostOptions) (hypnohub.PostID, error) {
+	r, err := EstimatePostRange(ctx, searcher, opts)
+	if err != nil {
+		return 0, err
+	}
+	return r.Lower, nil
+}
+
+// EstimatePostRange estimates the range of post IDs that were created within
+// the given time period or range. If the range ends in the past, then the
+// upper bound is estimated as well, costing another search.
+func EstimatePostRange(ctx context.Context, searcher PostsSearcher, opts EstimatePostOptions) (PostIDRange, error) {
+	if _, err := query.EscapedStatus(opts.Status); err != nil {
+		return PostIDRange{}, fmt.Errorf("invalid status: %w", err)
+	}
+
 	if opts.Now.IsZero() {
 		opts.Now = time.Now()
 	}
@@ -74,21 +225,162 @@ func EstimatePostHistory(ctx context.Context, searcher PostsSearcher, opts Estim
 		opts.Timezone = time.UTC
 	}
 	opts.Now = opts.Now.In(opts.Timezone)
-	timeThreshold := EarliestTimestampForPeriod(opts.Now, opts.Period)
+
+	if opts.Anchors != nil {
+		searcher = opts.Anchors.Searcher(searcher)
+	}
+
+	offsets := opts.Offsets
+	if offsets == nil {
+		offsets = NewOffsetTable()
+	}
+
+	e := estimator{searcher: searcher, opts: opts}
+
+	if opts.Range.From.IsZero() {
+		if opts.Period == AllTime {
+			return PostIDRange{}, nil
+		}
+		rules := DefaultPeriodRules
+		if opts.Rules != nil {
+			rules = *opts.Rules
+		}
+		threshold := rules.EarliestTimestamp(opts.Now, opts.Period)
+		maxOffset := offsets.MaxOffset(opts.Period)
+		lower, grownOffset, err := e.estimate(ctx, threshold, maxOffset)
+		if err != nil {
+			return PostIDRange{}, err
+		}
+		if grownOffset > maxOffset {
+			offsets.Learn(opts.Period, grownOffset)
+		}
+		return PostIDRange{Lower: lower}, nil
+	}
+
+	if !opts.Range.To.IsZero() && !opts.Range.From.Before(opts.Range.To) {
+		return PostIDRange{}, fmt.Errorf("invalid time range %v to %v", opts.Range.From, opts.Range.To)
+	}
+
+	var r PostIDRange
+	var err error
+
+	r.Lower, err = e.estimateSince(ctx, offsets, opts.Range.From)
+	if err != nil {
+		return PostIDRange{}, fmt.Errorf("estimating lower bound: %w", err)
+	}
+
+	if !opts.Range.To.IsZero() && opts.Range.To.Before(opts.Now) {
+		r.Upper, err = e.estimateSince(ctx, offsets, opts.Range.To)
+		if err != nil {
+			return PostIDRange{}, fmt.Errorf("estimating upper bound: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// estimateSince estimates the ID of the earliest post made since the given
+// time, extrapolating its maximum offset from the table and teaching the
+// table if the offset turns out to be too small.
+func (e *estimator) estimateSince(ctx context.Context, offsets *OffsetTable, since time.Time) (hypnohub.PostID, error) {
+	maxOffset := offsets.MaxOffsetSince(e.opts.Now, since)
+	id, grownOffset, err := e.estimate(ctx, since, maxOffset)
+	if err != nil {
+		return 0, err
+	}
+	if grownOffset > maxOffset {
+		offsets.LearnSince(e.opts.Now, since, grownOffset)
+	}
+	return id, nil
+}
+
+// estimator estimates the ID of the earliest post that was created at or
+// after a time threshold.
+type estimator struct {
+	searcher PostsSearcher
+	opts     EstimatePostOptions
+
+	lastProbe int // index of the last probe in opts.Trace
+}
+
+// filter adds the status filter, if any, to the given query.
+func (e *estimator) filter(q query.Query) query.Query {
+	if e.opts.Status == "" {
+		return q
+	}
+	return query.And(query.Status(e.opts.Status), q)
+}
+
+// estimate estimates the ID of the earliest post that was created at or after
+// the given time threshold using the configured method. maxOffset is the
+// maximum post offset to search, which only applies to
+// [BinarySearchMethod]. The maximum offset that was actually needed is
+// returned.
+func (e *estimator) estimate(ctx context.Context, threshold time.Time, maxOffset int) (hypnohub.PostID, int, error) {
+	switch e.opts.Method {
+	case BinarySearchMethod:
+		return e.binarySearch(ctx, threshold, maxOffset)
+	case InterpolationMethod:
+		id, err := e.interpolationSearch(ctx, threshold)
+		return id, maxOffset, err
+	default:
+		return 0, 0, fmt.Errorf("unknown estimate method %d", e.opts.Method)
+	}
+}
+
+// maxOffsetGrowths is the maximum number of times that binarySearch doubles
+// the maximum offset before giving up.
+const maxOffsetGrowths = 16
+
+// maxRefinePages is the maximum number of pages that refine walks through
+// before settling for the last post that it saw.
+const maxRefinePages = 8
+
+// binarySearch implements [BinarySearchMethod]. If every post up to maxOffset
+// is still within the period, then maxOffset is doubled until it isn't. The
+// final maxOffset is returned.
+//
+// The search only narrows the boundary down to around a page. Unless it
+// stops early because of the accuracy, the exact earliest post is then found
+// by refine.
+//
+// Posts that are deleted or approved between searches shift the offsets of
+// older posts, so pages can drift. Each page is checked against the pages
+// that were already fetched, and pages that disagree with it are forgotten.
+// Since refine walks by post ID rather than by offset, drift only costs extra
+// searches and never changes the result.
+func (e *estimator) binarySearch(ctx context.Context, timeThreshold time.Time, maxOffset int) (hypnohub.PostID, int, error) {
+	accuracy := e.opts.Accuracy
+	q := e.filter(nil).String()
 
 	const offsetCount = 2
 	offsets := make([]int, 0, offsetCount)
+	pages := make(map[int][]hypnohub.Post)
+
 	var postID hypnohub.PostID
+	var found bool
 
-	_, err := binarySearch(opts.Period.MaxOffset(), func(i int) (bool, error) {
-		page, err := searcher.SearchPosts(ctx, "", i)
+	// withinID is the last post of the oldest page seen that is entirely
+	// within the period.
+	var withinID hypnohub.PostID
+
+	f := func(i int) (bool, error) {
+		page, err := e.search(ctx, timeThreshold, q, i)
 		if err != nil {
 			// Can't do anything about this error, so just ignore it.
 			return false, fmt.Errorf("searching posts: %w", err)
 		}
 
+		note := ""
+		if pagesDrifted(pages, i, page.Posts) {
+			note = " (pages drifted)"
+			clear(pages)
+		}
+		pages[i] = page.Posts
+
 		if len(page.Posts) == 0 {
 			// We've gone too far back.
+			e.decide("past the oldest post, search newer%s", note)
 			return true, nil
 		}
 
@@ -97,6 +389,7 @@ func EstimatePostHistory(ctx context.Context, searcher PostsSearcher, opts Estim
 			// We determine this by checking if the gap between the last offset
 			// and the current offset is less than half the page size.
 			if last2IntsDifference(offsets) < 3 {
+				e.decide("stuck between nearby offsets, stop")
 				return false, binarySearchBreak
 			}
 
@@ -106,33 +399,210 @@ func EstimatePostHistory(ctx context.Context, searcher PostsSearcher, opts Estim
 			offsets = append(offsets, i)
 		}
 
-		j := sort.Search(len(page.Posts), func(i int) bool {
-			return page.Posts[i].CreatedAt.Time().Before(timeThreshold)
-		})
-
-		post := page.Posts[min(j, len(page.Posts)-1)]
+		j, ordered := lastPostSince(page.Posts, timeThreshold)
+		if !ordered {
+			note += " (page is out of order)"
+		}
 
-		if opts.Accuracy > 0 {
-			if timeWithinAccuracy(post.CreatedAt.Time(), timeThreshold, opts.Accuracy) {
+		if accuracy > 0 {
+			post := page.Posts[min(j+1, len(page.Posts)-1)]
+			if timeWithinAccuracy(post.CreatedAt.Time(), timeThreshold, accuracy) {
+				postID, found = post.ID, true
+				e.decide("post %d is within accuracy, stop", post.ID)
 				return false, binarySearchBreak
 			}
 		}
 
-		if j == len(page.Posts) {
-			// All posts are before the given time.
-			postID = post.ID
+		switch j {
+		case len(page.Posts) - 1:
+			// All posts are within the period.
+			if id := page.Posts[j].ID; !withinID.IsValid() || id < withinID {
+				withinID = id
+			}
+			e.decide("whole page is within the period, search older%s", note)
 			return false, nil
-		} else {
-			// Add 1 like how binarySearch does i + 1.
-			postID = post.ID + 1
+		case -1:
+			e.decide("post %d is before the threshold, search newer%s", page.Posts[0].ID, note)
 			return true, nil
+		default:
+			// The page has posts on both sides of the threshold.
+			postID, found = page.Posts[j].ID, true
+			e.decide("found post %d in the page, stop%s", postID, note)
+			return true, binarySearchBreak
 		}
-	})
+	}
+
+	minOffset := 0
+	maxOffset = max(maxOffset, 1)
+
+	for growths := 0; ; growths++ {
+		i, err := binarySearch(minOffset, maxOffset, f)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if found || i < maxOffset || growths == maxOffsetGrowths {
+			break
+		}
+
+		// The search never found a page older than the threshold, so the
+		// maximum offset is still within the period. Search past it.
+		minOffset, maxOffset = maxOffset, maxOffset*2
+		e.decide("maximum offset is still within the period, grow it to %d", maxOffset)
+		offsets = offsets[:0]
+	}
+
+	if !found {
+		var err error
+		postID, err = e.refine(ctx, timeThreshold, pages, withinID)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return postID, maxOffset, nil
+}
+
+// refine finds the exact earliest post created at or after the threshold
+// once binarySearch has narrowed it down. lastID is the last post of the
+// oldest page known to be entirely within the period, or 0 if there is none.
+// pages are the pages that were already fetched by their offset, which are
+// reused when possible.
+func (e *estimator) refine(ctx context.Context, threshold time.Time, pages map[int][]hypnohub.Post, lastID hypnohub.PostID) (hypnohub.PostID, error) {
+	for n := 0; n < maxRefinePages; n++ {
+		posts, err := e.postsAfter(ctx, threshold, pages, lastID)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(posts) == 0 {
+			if !lastID.IsValid() {
+				e.decide("there are no posts")
+				return 0, nil
+			}
+			e.decide("no posts past post %d, it is the earliest", lastID)
+			return lastID, nil
+		}
+
+		j, ordered := lastPostSince(posts, threshold)
+		note := ""
+		if !ordered {
+			note = " (page is out of order)"
+		}
+
+		switch j {
+		case len(posts) - 1:
+			// The boundary is further back than the search thought.
+			lastID = posts[j].ID
+			e.decide("whole page is within the period, refine older%s", note)
+		case -1:
+			if !lastID.IsValid() {
+				// No posts were made since the threshold, so the earliest
+				// post will be the next one.
+				e.decide("no posts since the threshold%s", note)
+				return posts[0].ID + 1, nil
+			}
+			e.decide("boundary is right before this page, post %d is the earliest%s", lastID, note)
+			return lastID, nil
+		default:
+			e.decide("found post %d in the page%s", posts[j].ID, note)
+			return posts[j].ID, nil
+		}
+	}
+
+	e.decide("gave up refining after %d pages, use post %d", maxRefinePages, lastID)
+	return lastID, nil
+}
+
+// postsAfter returns the posts listed right after the post with the given ID,
+// or the newest posts if the ID is 0. A fetched page that contains the post
+// and continues past it is reused. Otherwise, the posts are searched by ID
+// rather than by offset, so that they don't depend on posts that were deleted
+// or approved in the meantime.
+func (e *estimator) postsAfter(ctx context.Context, threshold time.Time, pages map[int][]hypnohub.Post, id hypnohub.PostID) ([]hypnohub.Post, error) {
+	var q query.Query
+	if id.IsValid() {
+		for _, posts := range pages {
+			i := slices.IndexFunc(posts, func(p hypnohub.Post) bool { return p.ID == id })
+			if i != -1 && i < len(posts)-1 {
+				return posts[i+1:], nil
+			}
+		}
+		q = query.ID(query.LessThan, id)
+	} else if posts, ok := pages[0]; ok {
+		return posts, nil
+	}
+
+	page, err := e.search(ctx, threshold, e.filter(q).String(), 0)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("searching posts: %w", err)
+	}
+	return page.Posts, nil
+}
+
+// pagesDrifted returns whether the page at the given offset disagrees with
+// any of the already fetched pages, meaning that posts were added or removed
+// in between the searches. Pages that overlap must have the same posts at the
+// same offsets, and pages at greater offsets must only have older posts.
+func pagesDrifted(pages map[int][]hypnohub.Post, offset int, posts []hypnohub.Post) bool {
+	if len(posts) == 0 {
+		return false
+	}
+
+	for o, other := range pages {
+		if len(other) == 0 {
+			continue
+		}
+
+		switch {
+		case o+len(other) <= offset:
+			if other[len(other)-1].ID <= posts[0].ID {
+				return true
+			}
+		case offset+len(posts) <= o:
+			if posts[len(posts)-1].ID <= other[0].ID {
+				return true
+			}
+		default:
+			for i := max(o, offset); i < min(o+len(other), offset+len(posts)); i++ {
+				if other[i-o].ID != posts[i-offset].ID {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// lastPostSince returns the index of the last post in the page that was
+// created at or after the threshold, or -1 if there is none. The page must be
+// sorted by descending ID.
+//
+// Posts are usually also sorted by descending creation time, but posts that
+// are approved late can be out of order, so every post is checked instead of
+// binary searching. Posts after the returned index were all created before
+// the threshold, so an ID filter from the returned post never misses a post
+// in the page that is within the period. ordered is false if a post before
+// the returned index was also created before the threshold.
+func lastPostSince(posts []hypnohub.Post, threshold time.Time) (i int, ordered bool) {
+	i = -1
+	for j := len(posts) - 1; j >= 0; j-- {
+		if !posts[j].CreatedAt.Time().Before(threshold) {
+			i = j
+			break
+		}
+	}
+
+	ordered = true
+	for _, post := range posts[:max(i, 0)] {
+		if post.CreatedAt.Time().Before(threshold) {
+			ordered = false
+			break
+		}
 	}
 
-	return postID, nil
+	return i, ordered
 }
 
 // timeWithinAccuracy returns whether the given time is within the given
@@ -155,10 +625,10 @@ func last2IntsDifference(ints []int) int {
 
 var binarySearchBreak = errors.New("binary search break")
 
-func binarySearch(n int, f func(int) (bool, error)) (int, error) {
-	// Define f(-1) == false and f(n) == true.
+func binarySearch(lo, hi int, f func(int) (bool, error)) (int, error) {
+	// Define f(lo-1) == false and f(hi) == true.
 	// Invariant: f(i-1) == false, f(j) == true.
-	i, j := 0, n
+	i, j := lo, hi
 	for i < j {
 		h := int(uint(i+j) >> 1) // avoid overflow when computing h
 
@@ -2,12 +2,22 @@ package popular
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/query"
 )
 
 func TestEstimatePostHistory(t *testing.T) {
@@ -17,10 +27,10 @@ func TestEstimatePostHistory(t *testing.T) {
 		{1999, testDate("01-02-2020 02:00")}, // yesterday
 		{1998, testDate("31-01-2020 23:00")}, // yesterday
 		{1997, testDate("31-01-2020 22:00")}, // yesterday
-		{1996, testDate("31-01-2020 21:00")}, // last week
+		{1996, testDate("31-01-2020 21:00")}, // yesterday
 		{1995, testDate("30-01-2020 21:00")}, // last week
 		{1994, testDate("25-01-2020 21:00")}, // last week
-		{1993, testDate("25-01-2020 20:00")}, // last month
+		{1993, testDate("25-01-2020 20:00")}, // last week
 		{1992, testDate("17-01-2020 21:00")}, // last month
 		{1991, testDate("10-01-2020 21:00")}, // last month
 		{1990, testDate("03-01-2020 21:00")}, // last month
@@ -40,8 +50,8 @@ func TestEstimatePostHistory(t *testing.T) {
 			name:     "day",
 			period:   Daily,
 			accuracy: 0,
-			wantID:   1997,
-			requests: 8,
+			wantID:   1996,
+			requests: 6,
 		},
 		{
 			name:     "day rough estimate",
@@ -53,20 +63,20 @@ func TestEstimatePostHistory(t *testing.T) {
 		{
 			name:     "week",
 			period:   Weekly,
-			wantID:   1994,
-			requests: 10,
+			wantID:   1993,
+			requests: 7,
 		},
 		{
 			name:     "month",
 			period:   Monthly,
 			wantID:   1990,
-			requests: 12,
+			requests: 11,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			searcher := searcher.withResetCounter()
+			searcher := NewCountingSearcher(searcher)
 			id, _ := EstimatePostHistory(context.Background(), searcher, EstimatePostOptions{
 				Now:      today,
 				Period:   test.period,
@@ -75,13 +85,755 @@ func TestEstimatePostHistory(t *testing.T) {
 			if id != test.wantID {
 				t.Errorf("expected %v, got %v", test.wantID, id)
 			}
-			if searcher.counter != test.requests {
-				t.Errorf("expected %v requests, got %v", test.requests, searcher.counter)
+			if searcher.Count() != test.requests {
+				t.Errorf("expected %v requests, got %v", test.requests, searcher.Count())
+			}
+		})
+	}
+}
+
+func TestEstimatePostHistoryOutOfOrder(t *testing.T) {
+	// The day starts at 31-01-2020 00:00. Some posts were approved out of
+	// order, so their IDs don't follow their creation times.
+	today := time.Date(2020, time.February, 1, 21, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		posts  []mockPost
+		wantID hypnohub.PostID
+	}{
+		{
+			name: "older post among newer ones",
+			posts: []mockPost{
+				{2000, testDate("01-02-2020 21:00")},
+				{1999, testDate("01-02-2020 02:00")},
+				{1998, testDate("31-01-2020 23:00")},
+				{1997, testDate("30-01-2020 22:00")}, // out of order
+				{1996, testDate("31-01-2020 05:00")},
+				{1995, testDate("30-01-2020 21:00")},
+				{1994, testDate("29-01-2020 21:00")},
+				{1993, testDate("28-01-2020 21:00")},
+				{1992, testDate("27-01-2020 21:00")},
+				{1991, testDate("26-01-2020 21:00")},
+			},
+			wantID: 1996,
+		},
+		{
+			name: "newer post among older ones",
+			posts: []mockPost{
+				{2000, testDate("01-02-2020 21:00")},
+				{1999, testDate("01-02-2020 02:00")},
+				{1998, testDate("31-01-2020 23:00")},
+				{1997, testDate("31-01-2020 22:00")},
+				{1996, testDate("30-01-2020 21:00")},
+				{1995, testDate("31-01-2020 01:00")}, // out of order
+				{1994, testDate("29-01-2020 21:00")},
+				{1993, testDate("28-01-2020 21:00")},
+				{1992, testDate("27-01-2020 21:00")},
+				{1991, testDate("26-01-2020 21:00")},
+			},
+			wantID: 1995,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := EstimatePostHistory(context.Background(), newPostsSearcher(test.posts), EstimatePostOptions{
+				Now:    today,
+				Period: Daily,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != test.wantID {
+				t.Errorf("expected %v, got %v", test.wantID, id)
+			}
+		})
+	}
+}
+
+func TestLastPostSince(t *testing.T) {
+	threshold := testDate("31-01-2020 00:00")
+	after := hypnohub.Date(testDate("31-01-2020 12:00"))
+	before := hypnohub.Date(testDate("30-01-2020 12:00"))
+
+	tests := []struct {
+		name        string
+		times       []hypnohub.Date
+		wantIndex   int
+		wantOrdered bool
+	}{
+		{"empty", nil, -1, true},
+		{"all after", []hypnohub.Date{after, after, after}, 2, true},
+		{"all before", []hypnohub.Date{before, before, before}, -1, true},
+		{"ordered", []hypnohub.Date{after, after, before}, 1, true},
+		{"before among after", []hypnohub.Date{after, before, after, before}, 2, false},
+		{"after among before", []hypnohub.Date{before, after, before}, 1, false},
+		{"at threshold", []hypnohub.Date{after, hypnohub.Date(threshold), before}, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			posts := make([]hypnohub.Post, len(test.times))
+			for i, createdAt := range test.times {
+				posts[i] = hypnohub.Post{ID: hypnohub.PostID(100 - i), CreatedAt: createdAt}
+			}
+
+			i, ordered := lastPostSince(posts, threshold)
+			if i != test.wantIndex || ordered != test.wantOrdered {
+				t.Errorf("expected (%d, %v), got (%d, %v)", test.wantIndex, test.wantOrdered, i, ordered)
+			}
+		})
+	}
+}
+
+func TestEstimatePostHistoryInterpolation(t *testing.T) {
+	today := time.Date(2020, time.February, 1, 21, 0, 0, 0, time.UTC)
+
+	var posts []mockPost
+	for i := 0; i < 200; i++ {
+		posts = append(posts, mockPost{
+			ID:   hypnohub.PostID(2000 - i),
+			Time: today.Add(-time.Duration(i) * 5 * time.Hour),
+		})
+	}
+	searcher := newPostsSearcher(posts)
+
+	tests := []struct {
+		name        string
+		period      TimePeriod
+		wantID      hypnohub.PostID
+		maxRequests int
+	}{
+		{
+			name:        "day",
+			period:      Daily,
+			wantID:      1991,
+			maxRequests: 4,
+		},
+		{
+			name:        "week",
+			period:      Weekly,
+			wantID:      1939,
+			maxRequests: 4,
+		},
+		{
+			name:        "month",
+			period:      Monthly,
+			wantID:      1847,
+			maxRequests: 4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			searcher := NewCountingSearcher(searcher)
+			id, err := EstimatePostHistory(context.Background(), searcher, EstimatePostOptions{
+				Now:    today,
+				Period: test.period,
+				Method: InterpolationMethod,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != test.wantID {
+				t.Errorf("expected %v, got %v", test.wantID, id)
+			}
+			if searcher.Count() > test.maxRequests {
+				t.Errorf("expected at most %v requests, got %v", test.maxRequests, searcher.Count())
+			}
+		})
+	}
+
+	// Posts made in bursts should still give exact results.
+	bursty := newPostsSearcher([]mockPost{
+		{2000, testDate("01-02-2020 21:00")},
+		{1999, testDate("01-02-2020 02:00")},
+		{1998, testDate("31-01-2020 23:00")},
+		{1997, testDate("31-01-2020 22:00")},
+		{1996, testDate("31-01-2020 21:00")},
+		{1995, testDate("30-01-2020 21:00")},
+		{1994, testDate("25-01-2020 21:00")},
+		{1993, testDate("25-01-2020 20:00")},
+		{1992, testDate("17-01-2020 21:00")},
+		{1991, testDate("10-01-2020 21:00")},
+		{1990, testDate("03-01-2020 21:00")},
+		{1989, testDate("27-12-2019 21:00")},
+		{1988, testDate("20-12-2019 21:00")},
+		{1987, testDate("13-12-2019 21:00")},
+	})
+	for period, wantID := range map[TimePeriod]hypnohub.PostID{
+		Daily:   1996,
+		Weekly:  1993,
+		Monthly: 1990,
+	} {
+		id, err := EstimatePostHistory(context.Background(), bursty, EstimatePostOptions{
+			Now:    today,
+			Period: period,
+			Method: InterpolationMethod,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != wantID {
+			t.Errorf("bursty %v: expected %v, got %v", period, wantID, id)
+		}
+	}
+}
+
+func TestEstimatePostHistoryAnchors(t *testing.T) {
+	today := time.Date(2020, time.February, 1, 21, 0, 0, 0, time.UTC)
+
+	var posts []mockPost
+	for i := 0; i < 200; i++ {
+		posts = append(posts, mockPost{
+			ID:   hypnohub.PostID(2000 - i),
+			Time: today.Add(-time.Duration(i) * 5 * time.Hour),
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "anchors.json")
+	estimate := func(period TimePeriod) (hypnohub.PostID, int) {
+		anchors, err := LoadAnchorStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		searcher := NewCountingSearcher(newPostsSearcher(posts))
+		id, err := EstimatePostHistory(context.Background(), searcher, EstimatePostOptions{
+			Now:     today,
+			Period:  period,
+			Method:  InterpolationMethod,
+			Anchors: anchors,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := anchors.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return id, searcher.Count()
+	}
+
+	id, requests := estimate(Weekly)
+	if id != 1939 {
+		t.Errorf("expected 1939, got %v", id)
+	}
+
+	// The anchors around the boundary were saved, so estimating the same
+	// period again after a restart should only need a single probe.
+	id, reusedRequests := estimate(Weekly)
+	if id != 1939 {
+		t.Errorf("expected 1939 from anchors, got %v", id)
+	}
+	if reusedRequests >= requests || reusedRequests > 1 {
+		t.Errorf("expected at most 1 request using anchors, got %v (vs %v)", reusedRequests, requests)
+	}
+}
+
+func TestAnchorStoreThinning(t *testing.T) {
+	anchors := NewAnchorStore()
+	anchors.MaxAnchors = 10
+
+	for i := 1; i <= 20; i++ {
+		anchors.Observe([]hypnohub.Post{{
+			ID:        hypnohub.PostID(i),
+			CreatedAt: hypnohub.Date(testDate("01-01-2020 00:00").Add(time.Duration(i) * time.Hour)),
+		}})
+	}
+
+	if n := anchors.Len(); n > 10 {
+		t.Errorf("expected at most 10 anchors, got %d", n)
+	}
+
+	lo, hi, hasLo, hasHi := anchors.nearest(testDate("01-01-2020 20:00"))
+	if !hasLo || !hasHi || lo.ID >= hi.ID || hi.ID != 20 {
+		t.Errorf("unexpected nearest anchors %v and %v", lo, hi)
+	}
+}
+
+func TestEstimatePostRange(t *testing.T) {
+	searcher := newPostsSearcher([]mockPost{
+		{2000, testDate("01-02-2020 21:00")},
+		{1999, testDate("01-02-2020 02:00")},
+		{1998, testDate("31-01-2020 23:00")},
+		{1997, testDate("30-01-2020 22:00")},
+		{1996, testDate("29-01-2020 21:00")},
+		{1995, testDate("28-01-2020 21:00")},
+		{1994, testDate("27-01-2020 21:00")},
+		{1993, testDate("26-01-2020 20:00")},
+		{1992, testDate("17-01-2020 21:00")},
+		{1991, testDate("10-01-2020 21:00")},
+		{1990, testDate("03-01-2020 21:00")},
+		{1989, testDate("27-12-2019 21:00")},
+		{1988, testDate("20-12-2019 21:00")},
+		{1987, testDate("13-12-2019 21:00")},
+	})
+
+	r, err := EstimatePostRange(context.Background(), searcher, EstimatePostOptions{
+		Now: testDate("01-02-2020 21:00"),
+		Range: TimeRange{
+			From: testDate("01-01-2020 00:00"),
+			To:   testDate("26-01-2020 00:00"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := PostIDRange{Lower: 1990, Upper: 1993}
+	if r != want {
+		t.Errorf("expected %+v, got %+v", want, r)
+	}
+
+	if q := r.Query().String(); q != "id:>=1990 id:<1993" {
+		t.Errorf("unexpected query %q", q)
+	}
+
+	_, err = EstimatePostRange(context.Background(), searcher, EstimatePostOptions{
+		Range: TimeRange{
+			From: testDate("26-01-2020 00:00"),
+			To:   testDate("01-01-2020 00:00"),
+		},
+	})
+	if err == nil {
+		t.Error("expected error for inverted range")
+	}
+}
+
+func TestEstimatePostHistoryDrift(t *testing.T) {
+	posts := []mockPost{
+		{2000, testDate("01-02-2020 21:00")},
+		{1999, testDate("01-02-2020 02:00")},
+		{1998, testDate("31-01-2020 23:00")},
+		{1997, testDate("31-01-2020 22:00")},
+		{1996, testDate("31-01-2020 21:00")},
+		{1995, testDate("30-01-2020 21:00")},
+		{1994, testDate("25-01-2020 21:00")},
+		{1993, testDate("25-01-2020 20:00")},
+		{1992, testDate("17-01-2020 21:00")},
+		{1991, testDate("10-01-2020 21:00")},
+		{1990, testDate("03-01-2020 21:00")},
+		{1989, testDate("27-12-2019 21:00")},
+		{1988, testDate("20-12-2019 21:00")},
+		{1987, testDate("13-12-2019 21:00")},
+	}
+
+	// Drift can only be noticed once two pages overlap, which doesn't
+	// happen for every period.
+	for _, test := range []struct {
+		period  TimePeriod
+		wantID  hypnohub.PostID
+		drifted bool
+	}{
+		{Daily, 1996, true},
+		{Weekly, 1993, false},
+		{Monthly, 1990, true},
+	} {
+		// The newest posts are deleted after every search that finds posts,
+		// so every older post moves to a smaller offset between searches.
+		mock := newPostsSearcher(slices.Clone(posts))
+		deletions := []hypnohub.PostID{2000, 1999, 1998}
+		searcher := PostsSearcherFunc(func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+			result, err := mock.SearchPosts(ctx, query, postOffset)
+			if err == nil && len(result.Posts) > 0 && len(deletions) > 0 {
+				deleted := deletions[0]
+				deletions = deletions[1:]
+				mock.posts = slices.DeleteFunc(mock.posts, func(p mockPost) bool { return p.ID == deleted })
+			}
+			return result, err
+		})
+		trace := &EstimateTrace{}
+
+		id, err := EstimatePostHistory(context.Background(), searcher, EstimatePostOptions{
+			Now:    testDate("01-02-2020 21:00"),
+			Period: test.period,
+			Trace:  trace,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != test.wantID {
+			t.Errorf("%v: expected %v, got %v", test.period, test.wantID, id)
+		}
+
+		drifted := slices.ContainsFunc(trace.Probes(), func(p EstimateProbe) bool {
+			return strings.Contains(p.Decision, "pages drifted")
+		})
+		if drifted != test.drifted {
+			t.Errorf("%v: expected drifted pages to be %v, got %v", test.period, test.drifted, drifted)
+		}
+	}
+}
+
+func TestEstimatePostHistoryStatus(t *testing.T) {
+	searcher := newPostsSearcher([]mockPost{
+		{2000, testDate("01-02-2020 21:00")},
+		{1999, testDate("01-02-2020 02:00")},
+		{1998, testDate("31-01-2020 23:00")},
+		{1997, testDate("30-01-2020 22:00")},
+		{1996, testDate("29-01-2020 21:00")},
+		{1995, testDate("28-01-2020 21:00")},
+	})
+	// The earliest post of the day is deleted, so only searching active
+	// posts skips it.
+	searcher.inactive = []hypnohub.PostID{1998}
+
+	for _, method := range []EstimateMethod{BinarySearchMethod, InterpolationMethod} {
+		for _, test := range []struct {
+			status string
+			wantID hypnohub.PostID
+		}{
+			{"", 1998},
+			{"active", 1999},
+		} {
+			trace := &EstimateTrace{}
+
+			id, err := EstimatePostHistory(context.Background(), NewCountingSearcher(searcher), EstimatePostOptions{
+				Now:    testDate("01-02-2020 21:00"),
+				Period: Daily,
+				Method: method,
+				Trace:  trace,
+				Status: test.status,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != test.wantID {
+				t.Errorf("method %d, status %q: expected %v, got %v", method, test.status, test.wantID, id)
+			}
+
+			if test.status == "" {
+				continue
+			}
+			for i, probe := range trace.Probes() {
+				if !strings.HasPrefix(probe.Query, "status:"+test.status) {
+					t.Errorf("method %d: probe %d has no status filter: %q", method, i, probe.Query)
+				}
+			}
+		}
+	}
+
+	if _, err := EstimatePostHistory(context.Background(), searcher, EstimatePostOptions{
+		Now:    testDate("01-02-2020 21:00"),
+		Period: Daily,
+		Status: "a*",
+	}); !errors.Is(err, query.ErrInvalidTag) {
+		t.Errorf("expected invalid status to be rejected, got %v", err)
+	}
+}
+
+func TestPagesDrifted(t *testing.T) {
+	page := func(ids ...hypnohub.PostID) []hypnohub.Post {
+		posts := make([]hypnohub.Post, len(ids))
+		for i, id := range ids {
+			posts[i] = hypnohub.Post{ID: id}
+		}
+		return posts
+	}
+
+	pages := map[int][]hypnohub.Post{
+		0: page(100, 99, 98),
+		6: page(94, 93, 92),
+	}
+
+	tests := []struct {
+		name    string
+		offset  int
+		posts   []hypnohub.Post
+		drifted bool
+	}{
+		{"same page", 0, page(100, 99, 98), false},
+		{"overlapping", 2, page(98, 97, 96), false},
+		{"between", 3, page(97, 96, 95), false},
+		{"empty", 9, page(), false},
+		{"post deleted", 2, page(97, 96, 95), true},
+		{"post added", 7, page(94, 93, 92), true},
+		{"newer than earlier page", 4, page(99, 96, 95), true},
+		{"older than later page", 3, page(93, 92, 91), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if drifted := pagesDrifted(pages, test.offset, test.posts); drifted != test.drifted {
+				t.Errorf("expected %v, got %v", test.drifted, drifted)
 			}
 		})
 	}
 }
 
+func TestEstimateTrace(t *testing.T) {
+	searcher := newPostsSearcher([]mockPost{
+		{2000, testDate("01-02-2020 21:00")},
+		{1999, testDate("01-02-2020 02:00")},
+		{1998, testDate("31-01-2020 23:00")},
+		{1997, testDate("30-01-2020 22:00")},
+		{1996, testDate("29-01-2020 21:00")},
+		{1995, testDate("28-01-2020 21:00")},
+		{1994, testDate("27-01-2020 21:00")},
+		{1993, testDate("26-01-2020 20:00")},
+	})
+
+	for _, method := range []EstimateMethod{BinarySearchMethod, InterpolationMethod} {
+		searcher := NewCountingSearcher(searcher)
+		trace := &EstimateTrace{}
+
+		_, err := EstimatePostHistory(context.Background(), searcher, EstimatePostOptions{
+			Now:    testDate("01-02-2020 21:00"),
+			Period: Weekly,
+			Method: method,
+			Trace:  trace,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		probes := trace.Probes()
+		if len(probes) != searcher.Count() {
+			t.Errorf("method %d: expected %d probes, got %d", method, searcher.Count(), len(probes))
+		}
+		for i, probe := range probes {
+			if probe.Decision == "" {
+				t.Errorf("method %d: probe %d has no decision: %+v", method, i, probe)
+			}
+			if probe.Posts > 0 && (!probe.FirstID.IsValid() || probe.LastCreatedAt.IsZero()) {
+				t.Errorf("method %d: probe %d is missing its page: %+v", method, i, probe)
+			}
+		}
+
+		var b strings.Builder
+		if _, err := trace.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(b.String(), "\n"); lines != len(probes)+1 {
+			t.Errorf("method %d: expected %d table lines, got %d", method, len(probes)+1, lines)
+		}
+	}
+}
+
+func TestEstimatePostBatch(t *testing.T) {
+	today := time.Date(2020, time.February, 1, 21, 0, 0, 0, time.UTC)
+
+	var posts []mockPost
+	for i := 0; i < 200; i++ {
+		posts = append(posts, mockPost{
+			ID:   hypnohub.PostID(2000 - i),
+			Time: today.Add(-time.Duration(i) * 5 * time.Hour),
+		})
+	}
+	searcher := NewCountingSearcher(newPostsSearcher(posts))
+
+	periods := []TimePeriod{Daily, DailyYesterday, Weekly, Monthly}
+	offsets := NewOffsetTable()
+
+	// pages records every page searched for by the independent estimates.
+	pages := make(map[cachedSearchKey]bool)
+	recorder := PostsSearcherFunc(func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+		pages[cachedSearchKey{query, postOffset}] = true
+		return searcher.SearchPosts(ctx, query, postOffset)
+	})
+
+	want := make(map[TimePeriod]hypnohub.PostID)
+	for _, period := range periods {
+		id, err := EstimatePostHistory(context.Background(), recorder, EstimatePostOptions{
+			Now:     today,
+			Period:  period,
+			Offsets: offsets,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[period] = id
+	}
+	requests := searcher.Count()
+
+	var mu sync.Mutex
+	fetched := make(map[cachedSearchKey]int)
+	batchSearcher := PostsSearcherFunc(func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+		mu.Lock()
+		fetched[cachedSearchKey{query, postOffset}]++
+		mu.Unlock()
+		return searcher.SearchPosts(ctx, query, postOffset)
+	})
+
+	got, err := EstimatePostBatch(context.Background(), batchSearcher, BatchEstimateOptions{
+		EstimatePostOptions: EstimatePostOptions{
+			Now:     today,
+			Offsets: offsets,
+		},
+		Periods:     periods,
+		MaxParallel: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !maps.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Every page is only searched once, so the batch costs at most as much as
+	// the distinct pages that the independent estimates needed, rather than
+	// their sum.
+	for key, n := range fetched {
+		if n > 1 {
+			t.Errorf("expected page %q at offset %d to be searched once, got %d", key.query, key.offset, n)
+		}
+	}
+	if len(fetched) > len(pages) {
+		t.Errorf("expected at most %d distinct pages, got %d", len(pages), len(fetched))
+	}
+	if len(pages) >= requests {
+		t.Fatalf("expected the periods to share pages, got %d distinct pages out of %d requests", len(pages), requests)
+	}
+}
+
+func TestEstimatePostBatchCancel(t *testing.T) {
+	today := time.Date(2020, time.February, 1, 21, 0, 0, 0, time.UTC)
+	posts := newPostsSearcher([]mockPost{
+		{2000, today},
+		{1999, today.Add(-48 * time.Hour)},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first search gives up on the batch, so the searches queued behind
+	// it must not reach the upstream.
+	var calls atomic.Int64
+	searcher := PostsSearcherFunc(func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+		if calls.Add(1) == 1 {
+			cancel()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return posts.SearchPosts(ctx, query, postOffset)
+	})
+
+	_, err := EstimatePostBatch(ctx, searcher, BatchEstimateOptions{
+		EstimatePostOptions: EstimatePostOptions{Now: today},
+		Periods:             []TimePeriod{Daily, DailyYesterday, Weekly, Monthly},
+		MaxParallel:         1,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the batch to be cancelled, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected no searches after the batch was cancelled, got %d", n-1)
+	}
+
+	calls.Store(0)
+	if _, err := EstimatePostBatch(ctx, searcher, BatchEstimateOptions{
+		EstimatePostOptions: EstimatePostOptions{Now: today},
+		Periods:             []TimePeriod{Daily, Weekly},
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled batch to fail, got %v", err)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("expected a cancelled batch to not search, got %d searches", n)
+	}
+}
+
+func TestEstimatePostHistoryGrowsOffset(t *testing.T) {
+	today := testDate("01-02-2020 21:00")
+
+	var posts []mockPost
+	for i := 0; i < 20; i++ {
+		posts = append(posts, mockPost{
+			ID:   hypnohub.PostID(2000 - i),
+			Time: today.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	searcher := newPostsSearcher(posts)
+
+	offsets := NewOffsetTable()
+	if err := json.Unmarshal([]byte(`{"last-24-hours": 4}`), offsets); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := EstimatePostHistory(context.Background(), searcher, EstimatePostOptions{
+		Now:     today,
+		Period:  Last24Hours,
+		Offsets: offsets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every post is within the last 24 hours, so the oldest one should be
+	// found even though the table only allows searching 4 posts back.
+	if id != 1981 {
+		t.Errorf("expected 1981, got %v", id)
+	}
+
+	if offset := offsets.MaxOffset(Last24Hours); offset < len(posts) {
+		t.Errorf("expected to learn an offset of at least %d, got %d", len(posts), offset)
+	}
+}
+
+func TestEstimatePostRangeGrowsOffset(t *testing.T) {
+	today := testDate("01-02-2020 21:00")
+
+	var posts []mockPost
+	for i := 0; i < 20; i++ {
+		posts = append(posts, mockPost{
+			ID:   hypnohub.PostID(2000 - i),
+			Time: today.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	searcher := newPostsSearcher(posts)
+
+	offsets := NewOffsetTable()
+	if err := json.Unmarshal([]byte(`{"daily": 2, "monthly": 2}`), offsets); err != nil {
+		t.Fatal(err)
+	}
+
+	from := today.Add(-15*time.Hour - 30*time.Minute)
+	if offset := offsets.MaxOffsetSince(today, from); offset != 2 {
+		t.Fatalf("expected extrapolated offset 2, got %d", offset)
+	}
+
+	r, err := EstimatePostRange(context.Background(), searcher, EstimatePostOptions{
+		Now:     today,
+		Range:   TimeRange{From: from},
+		Offsets: offsets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Lower != 1985 {
+		t.Errorf("expected 1985, got %v", r.Lower)
+	}
+
+	if offset := offsets.MaxOffsetSince(today, from); offset < 15 {
+		t.Errorf("expected to learn an offset of at least 15 since %v, got %d", from, offset)
+	}
+}
+
+func TestOffsetTableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+
+	offsets, err := LoadOffsetTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset := offsets.MaxOffset(Daily); offset != Daily.MaxOffset() {
+		t.Errorf("expected default offset %d, got %d", Daily.MaxOffset(), offset)
+	}
+
+	offsets.Learn(Daily, 1000)
+	offsets.Learn(Daily, 500)
+
+	offsets, err = LoadOffsetTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset := offsets.MaxOffset(Daily); offset != 1000 {
+		t.Errorf("expected learned offset 1000, got %d", offset)
+	}
+}
+
 func testDate(str string) time.Time {
 	t, err := time.Parse("02-01-2006 15:04", str)
 	if err != nil {
@@ -100,43 +852,86 @@ func (p mockPost) String() string {
 }
 
 type mockPostsSearcher struct {
-	posts   []mockPost
-	counter int
+	posts    []mockPost
+	inactive []hypnohub.PostID // posts that status:active leaves out
 }
 
 func newPostsSearcher(posts []mockPost) *mockPostsSearcher {
 	return &mockPostsSearcher{posts: posts}
 }
 
-func (s *mockPostsSearcher) withResetCounter() *mockPostsSearcher {
-	return &mockPostsSearcher{posts: s.posts}
-}
-
 func (s *mockPostsSearcher) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
-	log.Println("searching posts after", postOffset)
-	s.counter++
+	log.Printf("searching posts %q after %d", query, postOffset)
+
+	matched := s.filter(query)
 
-	if postOffset >= len(s.posts) {
+	if postOffset >= len(matched) {
 		return &hypnohub.SearchPostsResult{
 			Posts:  []hypnohub.Post{},
-			Count:  len(s.posts),
+			Count:  len(matched),
 			Offset: postOffset,
 		}, nil
 	}
 
 	const limit = 3
 	posts := make([]hypnohub.Post, 0, limit)
-	for i := postOffset; i < len(s.posts) && len(posts) < limit; i++ {
-		log.Printf("  adding post %s", s.posts[i])
+	for i := postOffset; i < len(matched) && len(posts) < limit; i++ {
+		log.Printf("  adding post %s", matched[i])
 		posts = append(posts, hypnohub.Post{
-			ID:        s.posts[i].ID,
-			CreatedAt: hypnohub.Date(s.posts[i].Time),
+			ID:        matched[i].ID,
+			CreatedAt: hypnohub.Date(matched[i].Time),
 		})
 	}
 
 	return &hypnohub.SearchPostsResult{
 		Posts:  posts,
-		Count:  len(s.posts),
+		Count:  len(matched),
 		Offset: postOffset,
 	}, nil
 }
+
+// filter returns the posts matching the query. It only understands the
+// id:<=, id:< and id:>= filters, the status:active filter and the sort:id:asc
+// sort. Since mock posts have no scores, sort:score:desc keeps the posts in ID
+// order.
+func (s *mockPostsSearcher) filter(query string) []mockPost {
+	posts := s.posts
+	for _, field := range strings.Fields(query) {
+		switch {
+		case strings.HasPrefix(field, "id:<="):
+			maxID := parseMockID(field, "id:<=")
+			posts = slices.DeleteFunc(slices.Clone(posts), func(p mockPost) bool {
+				return p.ID > maxID
+			})
+		case strings.HasPrefix(field, "id:<"):
+			endID := parseMockID(field, "id:<")
+			posts = slices.DeleteFunc(slices.Clone(posts), func(p mockPost) bool {
+				return p.ID >= endID
+			})
+		case strings.HasPrefix(field, "id:>="):
+			minID := parseMockID(field, "id:>=")
+			posts = slices.DeleteFunc(slices.Clone(posts), func(p mockPost) bool {
+				return p.ID < minID
+			})
+		case field == "sort:id:asc":
+			posts = slices.Clone(posts)
+			slices.Reverse(posts)
+		case field == "status:active":
+			posts = slices.DeleteFunc(slices.Clone(posts), func(p mockPost) bool {
+				return slices.Contains(s.inactive, p.ID)
+			})
+		case field == "sort:score:desc":
+		default:
+			panic("unsupported query " + field)
+		}
+	}
+	return posts
+}
+
+func parseMockID(field, prefix string) hypnohub.PostID {
+	id, err := strconv.Atoi(strings.TrimPrefix(field, prefix))
+	if err != nil {
+		panic(err)
+	}
+	return hypnohub.PostID(id)
+}
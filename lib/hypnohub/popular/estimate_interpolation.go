@@ -0,0 +1,161 @@
+package popular
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/query"
+)
+
+// maxInterpolationProbes is the maximum number of ID probes that
+// interpolationSearch makes before giving up.
+const maxInterpolationProbes = 64
+
+// anchor is a post ID that is known to have been created at a certain time.
+type anchor struct {
+	ID        hypnohub.PostID `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func postAnchor(post hypnohub.Post) anchor {
+	return anchor{ID: post.ID, CreatedAt: post.CreatedAt.Time()}
+}
+
+// interpolationSearch implements [InterpolationMethod].
+//
+// It keeps two anchors: lo, which is created before the threshold, and hi,
+// which is created at or after it. Each probe lists the posts with an ID at
+// most some guess between them, and either finds the earliest post within
+// that page or moves one of the anchors to the page.
+func (e *estimator) interpolationSearch(ctx context.Context, threshold time.Time) (hypnohub.PostID, error) {
+	search := func(q query.Query) ([]hypnohub.Post, error) {
+		page, err := e.search(ctx, threshold, e.filter(q).String(), 0)
+		if err != nil {
+			return nil, fmt.Errorf("searching posts: %w", err)
+		}
+		return page.Posts, nil
+	}
+
+	var lo, hi anchor
+	var hasLo, hasHi bool
+	if e.opts.Anchors != nil {
+		lo, hi, hasLo, hasHi = e.opts.Anchors.nearest(threshold)
+	}
+
+	if !hasHi {
+		// Start with the newest post as the upper anchor.
+		posts, err := search(nil)
+		if err != nil {
+			return 0, err
+		}
+		if len(posts) == 0 {
+			e.decide("there are no posts")
+			return 0, nil
+		}
+		if id, ok := earliestPostInPage(posts, threshold); ok {
+			e.decide("found post %d in the newest page", id)
+			return id, nil
+		}
+		if posts[0].CreatedAt.Time().Before(threshold) {
+			// No posts were made since the threshold, so the earliest post
+			// will be the next one.
+			e.decide("no posts since the threshold")
+			return posts[0].ID + 1, nil
+		}
+		hi = postAnchor(posts[len(posts)-1])
+		e.decide("use post %d as the upper anchor", hi.ID)
+	}
+
+	if !hasLo {
+		// Then use the oldest post as the lower anchor.
+		posts, err := search(query.Sort(query.SortID, query.SortAscending))
+		if err != nil {
+			return 0, err
+		}
+		if len(posts) == 0 || !posts[0].CreatedAt.Time().Before(threshold) {
+			// Every post was made since the threshold.
+			e.decide("every post was made since the threshold")
+			return 0, nil
+		}
+		lo = postAnchor(posts[0])
+		e.decide("use post %d as the lower anchor", lo.ID)
+	}
+
+	bisect := false
+	for probes := 0; probes < maxInterpolationProbes; probes++ {
+		if hi.ID-lo.ID <= 1 {
+			return hi.ID, nil
+		}
+
+		if e.opts.Accuracy > 0 && hi.CreatedAt.Sub(threshold) < e.opts.Accuracy {
+			return hi.ID, nil
+		}
+
+		var guess hypnohub.PostID
+		if bisect {
+			guess = lo.ID + (hi.ID-lo.ID)/2
+		} else {
+			guess = interpolateID(lo, hi, threshold)
+		}
+		guess = min(max(guess, lo.ID+1), hi.ID-1)
+
+		posts, err := search(query.ID(query.LessEqual, guess))
+		if err != nil {
+			return 0, err
+		}
+
+		width := hi.ID - lo.ID
+
+		switch {
+		case len(posts) == 0 || posts[0].ID <= lo.ID:
+			// There are no posts between lo and the guess, so pretend that lo
+			// is at the guess.
+			lo.ID = guess
+			e.decide("no posts between the lower anchor and %d, move it up", guess)
+		case posts[0].CreatedAt.Time().Before(threshold):
+			// The newest post up to the guess is still before the threshold,
+			// and there are no posts between it and the guess.
+			lo = anchor{ID: guess, CreatedAt: posts[0].CreatedAt.Time()}
+			e.decide("guess %d is before the threshold, move the lower anchor up", guess)
+		default:
+			if id, ok := earliestPostInPage(posts, threshold); ok {
+				e.decide("found post %d", id)
+				return id, nil
+			}
+			hi = postAnchor(posts[len(posts)-1])
+			e.decide("guess %d is after the threshold, move the upper anchor down to %d", guess, hi.ID)
+		}
+
+		// Fall back to bisecting if interpolating didn't halve the range,
+		// which happens when posts are made in bursts.
+		bisect = !bisect && hi.ID-lo.ID > width/2
+	}
+
+	return 0, fmt.Errorf("interpolation search did not converge after %d probes", maxInterpolationProbes)
+}
+
+// interpolateID guesses the ID of the post created at the threshold by
+// assuming that posts between lo and hi are created at a constant rate.
+func interpolateID(lo, hi anchor, threshold time.Time) hypnohub.PostID {
+	span := hi.CreatedAt.Sub(lo.CreatedAt)
+	if span <= 0 {
+		return lo.ID + (hi.ID-lo.ID)/2
+	}
+	frac := float64(threshold.Sub(lo.CreatedAt)) / float64(span)
+	return lo.ID + hypnohub.PostID(frac*float64(hi.ID-lo.ID))
+}
+
+// earliestPostInPage returns the ID of the earliest post in the page that was
+// created at or after the threshold. The page must be sorted by descending ID.
+// It only returns true if the page also contains a post from before the
+// threshold, meaning that the returned post is the earliest one overall. See
+// [lastPostSince] for how posts that are out of order are handled.
+func earliestPostInPage(posts []hypnohub.Post, threshold time.Time) (hypnohub.PostID, bool) {
+	i, _ := lastPostSince(posts, threshold)
+	if i < 0 || i == len(posts)-1 {
+		return 0, false
+	}
+	return posts[i].ID, true
+}
@@ -0,0 +1,189 @@
+package popular
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// OffsetTable is a table of the maximum post offsets to search for each time
+// period. It starts out with [EstimatePostMaxOffsets] and learns larger
+// offsets whenever the estimator finds that they are too small, which happens
+// when the site becomes more active. It is safe to use from multiple
+// goroutines.
+type OffsetTable struct {
+	mu      sync.Mutex
+	offsets map[TimePeriod]int
+	path    string
+
+	saveMu sync.Mutex // serializes writes to path
+}
+
+// NewOffsetTable creates a new in-memory OffsetTable.
+func NewOffsetTable() *OffsetTable {
+	return &OffsetTable{offsets: make(map[TimePeriod]int)}
+}
+
+// LoadOffsetTable loads an OffsetTable from the given JSON file. The returned
+// table writes itself back to the file whenever it learns a new offset. If
+// the file does not exist, then it is created once an offset is learned.
+func LoadOffsetTable(path string) (*OffsetTable, error) {
+	t := NewOffsetTable()
+	t.path = path
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return t, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("parsing offset table %s: %w", path, err)
+	}
+
+	return t, nil
+}
+
+// MaxOffset returns the maximum offset for the given time period. If no
+// offset has been learned, then [TimePeriod.MaxOffset] is returned.
+func (t *OffsetTable) MaxOffset(period TimePeriod) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.maxOffset(period)
+}
+
+func (t *OffsetTable) maxOffset(period TimePeriod) int {
+	if offset, ok := t.offsets[period]; ok {
+		return offset
+	}
+	return period.MaxOffset()
+}
+
+// monthDuration is the length of the month that [OffsetTable.MaxOffsetSince]
+// extrapolates from.
+const monthDuration = 30 * 24 * time.Hour
+
+// MaxOffsetSince returns the maximum offset for posts made since the given
+// time. It is extrapolated from the maximum offset of [Monthly], and is at
+// least the maximum offset of [Daily].
+func (t *OffsetTable) MaxOffsetSince(now, since time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offset := int(float64(t.maxOffset(Monthly)) * float64(now.Sub(since)) / float64(monthDuration))
+	return max(offset, t.maxOffset(Daily))
+}
+
+// Learn records that the given time period needs at least the given maximum
+// offset. Offsets smaller than the current one are ignored.
+func (t *OffsetTable) Learn(period TimePeriod, offset int) {
+	t.mu.Lock()
+	if offset <= t.maxOffset(period) {
+		t.mu.Unlock()
+		return
+	}
+	t.offsets[period] = offset
+	t.mu.Unlock()
+
+	if t.path != "" {
+		if err := t.save(); err != nil {
+			slog.Warn(
+				"cannot save learned post offsets",
+				"path", t.path,
+				"err", err)
+		}
+	}
+}
+
+// LearnSince records that posts made since the given time need at least the
+// given maximum offset. Since [OffsetTable.MaxOffsetSince] extrapolates from
+// [Monthly], the offset is learned for [Monthly] by scaling it to a month.
+func (t *OffsetTable) LearnSince(now, since time.Time, offset int) {
+	if !since.Before(now) {
+		return
+	}
+	monthly := int(float64(offset) * float64(monthDuration) / float64(now.Sub(since)))
+	t.Learn(Monthly, monthly)
+}
+
+// clone returns an in-memory copy of the table.
+func (t *OffsetTable) clone() *OffsetTable {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &OffsetTable{offsets: maps.Clone(t.offsets)}
+}
+
+// save writes the table to its file. The file is written without holding
+// t.mu, and writes are serialized so that the file ends up with the latest
+// offsets.
+func (t *OffsetTable) save() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	b, err := json.MarshalIndent(t.offsets, "", "\t")
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(t.path, b)
+}
+
+// MarshalJSON implements json.Marshaler. The table is encoded as an object
+// of time period names to offsets.
+func (t *OffsetTable) MarshalJSON() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return json.Marshal(t.offsets)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *OffsetTable) UnmarshalJSON(b []byte) error {
+	var offsets map[TimePeriod]int
+	if err := json.Unmarshal(b, &offsets); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.offsets == nil {
+		t.offsets = make(map[TimePeriod]int, len(offsets))
+	}
+	for period, offset := range offsets {
+		if offset > 0 {
+			t.offsets[period] = offset
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file by writing to a temporary file and then
+// renaming it, so that the file is never left half-written.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
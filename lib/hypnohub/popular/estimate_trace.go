@@ -0,0 +1,152 @@
+package popular
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+// EstimateTrace records every probe that an estimate makes, which helps with
+// debugging estimates that turn out wrong. It is safe to use from multiple
+// goroutines.
+type EstimateTrace struct {
+	mu     sync.Mutex
+	probes []EstimateProbe
+}
+
+// EstimateProbe is a single search made while estimating.
+type EstimateProbe struct {
+	// Threshold is the time that the estimate was looking for.
+	Threshold time.Time `json:"threshold"`
+	// Query is the query that was searched.
+	Query string `json:"query"`
+	// Offset is the post offset that was searched.
+	Offset int `json:"offset"`
+	// Posts is the number of posts in the returned page.
+	Posts int `json:"posts"`
+	// FirstID and FirstCreatedAt describe the first post in the page.
+	FirstID        hypnohub.PostID `json:"first_id,omitempty"`
+	FirstCreatedAt time.Time       `json:"first_created_at"`
+	// LastID and LastCreatedAt describe the last post in the page.
+	LastID        hypnohub.PostID `json:"last_id,omitempty"`
+	LastCreatedAt time.Time       `json:"last_created_at"`
+	// Decision is what the estimator decided to do after the probe.
+	Decision string `json:"decision,omitempty"`
+	// Elapsed is how long the search took.
+	Elapsed time.Duration `json:"elapsed"`
+	// Error is the error returned by the search, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Probes returns the recorded probes in the order that they were made.
+func (t *EstimateTrace) Probes() []EstimateProbe {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.probes)
+}
+
+// WriteTo writes the probes to w as a table. It implements io.WriterTo.
+func (t *EstimateTrace) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	tw := tabwriter.NewWriter(cw, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "#\tTHRESHOLD\tQUERY\tOFFSET\tPOSTS\tFIRST\tLAST\tELAPSED\tDECISION")
+	for i, p := range t.Probes() {
+		decision := p.Decision
+		if p.Error != "" {
+			decision = "error: " + p.Error
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%q\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			i+1,
+			p.Threshold.Format(time.RFC3339),
+			p.Query,
+			p.Offset,
+			p.Posts,
+			formatProbePost(p.FirstID, p.FirstCreatedAt),
+			formatProbePost(p.LastID, p.LastCreatedAt),
+			p.Elapsed.Round(time.Millisecond),
+			decision)
+	}
+
+	err := tw.Flush()
+	return cw.n, err
+}
+
+func formatProbePost(id hypnohub.PostID, createdAt time.Time) string {
+	if !id.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d (%s)", id, createdAt.Format(time.RFC3339))
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// record records the probe and returns its index.
+func (t *EstimateTrace) record(p EstimateProbe) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.probes = append(t.probes, p)
+	return len(t.probes) - 1
+}
+
+// decide sets the decision of the probe at index i.
+func (t *EstimateTrace) decide(i int, decision string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i >= 0 && i < len(t.probes) {
+		t.probes[i].Decision = decision
+	}
+}
+
+// search searches for posts, recording the probe in the trace if there is
+// one. threshold is the time that the estimator is currently looking for.
+func (e *estimator) search(ctx context.Context, threshold time.Time, query string, offset int) (*hypnohub.SearchPostsResult, error) {
+	if e.opts.Trace == nil {
+		return e.searcher.SearchPosts(ctx, query, offset)
+	}
+
+	start := time.Now()
+	result, err := e.searcher.SearchPosts(ctx, query, offset)
+
+	probe := EstimateProbe{
+		Threshold: threshold,
+		Query:     query,
+		Offset:    offset,
+		Elapsed:   time.Since(start),
+	}
+	if err != nil {
+		probe.Error = err.Error()
+	} else if len(result.Posts) > 0 {
+		first := result.Posts[0]
+		last := result.Posts[len(result.Posts)-1]
+		probe.Posts = len(result.Posts)
+		probe.FirstID, probe.FirstCreatedAt = first.ID, first.CreatedAt.Time()
+		probe.LastID, probe.LastCreatedAt = last.ID, last.CreatedAt.Time()
+	}
+
+	e.lastProbe = e.opts.Trace.record(probe)
+	return result, err
+}
+
+// decide records the decision made after the estimator's last probe, if there
+// is a trace.
+func (e *estimator) decide(format string, args ...any) {
+	if e.opts.Trace != nil {
+		e.opts.Trace.decide(e.lastProbe, fmt.Sprintf(format, args...))
+	}
+}
@@ -2,79 +2,698 @@ package popular
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
 	"sync"
 	"time"
 
+	"libdb.so/hypnoview/lib/hypnohub"
 	"libdb.so/hypnoview/lib/hypnohub/query"
 )
 
+// DefaultMaxTimezones is the default maximum number of timezones that a
+// [PopularQueryUpdater] caches queries for.
+const DefaultMaxTimezones = 16
+
+// DefaultTimezoneEvictionInterval is the default minimum time between two
+// timezones being evicted from a [PopularQueryUpdater]'s cache.
+const DefaultTimezoneEvictionInterval = time.Minute
+
+const (
+	// DefaultRefreshInterval is the default interval at which
+	// [PopularQueryUpdater.Run] checks for queries to refresh.
+	DefaultRefreshInterval = time.Minute
+	// DefaultRefreshLead is the default time before a time period's boundary
+	// at which [PopularQueryUpdater.Run] precomputes its next query.
+	DefaultRefreshLead = 5 * time.Minute
+	// DefaultRefreshTimeout is the default maximum time that a
+	// [PopularQueryUpdater] spends computing a single query.
+	DefaultRefreshTimeout = 2 * time.Minute
+	// DefaultRefreshBackoff is the default time that a [PopularQueryUpdater]
+	// waits after a failed refresh before trying again.
+	DefaultRefreshBackoff = 30 * time.Second
+)
+
+// ErrRefreshTimeout is returned by [PopularQueryUpdater.QueryPopularWith] when
+// no query has been computed yet and computing it took longer than
+// [PopularQueryUpdaterOptions.RefreshTimeout].
+var ErrRefreshTimeout = errors.New("popular query refresh timed out")
+
+// ErrTooManyTimezones is returned by [PopularQueryUpdater.QueryPopularWith]
+// when a query is requested for a timezone that is not cached, the cache is
+// full, and a timezone was already evicted too recently. See
+// [PopularQueryUpdaterOptions.TimezoneEvictionInterval].
+var ErrTooManyTimezones = errors.New("too many timezones requested, try again later")
+
+// PopularQueryUpdaterOptions are options for a [PopularQueryUpdater].
+type PopularQueryUpdaterOptions struct {
+	// MaxTimezones is the maximum number of timezones to cache queries for.
+	// When a query is requested for a new timezone and the cache is full, the
+	// least recently used timezone is evicted. UTC is never evicted and does
+	// not count towards this limit. If 0, then [DefaultMaxTimezones] is used.
+	MaxTimezones int
+	// TimezoneEvictionInterval is the minimum time between two timezones
+	// being evicted. Every new timezone costs a full estimate, so this limits
+	// how quickly clients cycling through timezones can make the updater
+	// search. Until then, queries for new timezones fail with
+	// [ErrTooManyTimezones]. If 0, then [DefaultTimezoneEvictionInterval] is
+	// used. If negative, then evictions are not limited.
+	TimezoneEvictionInterval time.Duration
+	// Rules are the rules that decide when each time period starts. If nil,
+	// then [DefaultPeriodRules] is used.
+	Rules *PeriodRules
+	// Offsets is the table of maximum offsets to search for each time period.
+	// If nil, then a new in-memory table is used.
+	Offsets *OffsetTable
+	// Method is the method used to estimate the earliest post in each time
+	// period. If zero, then [BinarySearchMethod] is used.
+	Method EstimateMethod
+	// Anchors, if not nil, records the posts seen while estimating and lets
+	// [InterpolationMethod] start from them.
+	Anchors *AnchorStore
+	// Status, if not empty, only searches posts with the given status while
+	// estimating. See [EstimatePostOptions.Status].
+	Status string
+	// RefreshInterval is the interval at which [PopularQueryUpdater.Run]
+	// checks for queries to refresh. If 0, then [DefaultRefreshInterval] is
+	// used.
+	RefreshInterval time.Duration
+	// Store, if not nil, persists the computed queries so that they can be
+	// restored using [PopularQueryUpdater.Restore] after a restart.
+	Store PopularQueryStore
+	// RefreshLead is how long before a time period's boundary
+	// [PopularQueryUpdater.Run] precomputes the query for the next period. If
+	// 0, then [DefaultRefreshLead] is used.
+	RefreshLead time.Duration
+	// RefreshTimeout is the maximum time spent computing a single query, so
+	// that a stuck upstream cannot block a query forever. If 0, then
+	// [DefaultRefreshTimeout] is used.
+	RefreshTimeout time.Duration
+	// RefreshBackoff is how long to wait after a failed refresh before
+	// trying again, so that an upstream outage doesn't cause a full estimate
+	// on every request. Meanwhile, the stale query or the error of the failed
+	// refresh is returned. If 0, then [DefaultRefreshBackoff] is used.
+	RefreshBackoff time.Duration
+}
+
 // PopularQueryUpdater is a struct that contains the queries for each time
 // period. It automatically updates the queries when needed. It is safe to use
 // from multiple goroutines.
+//
+// Queries are refreshed in the background. Once a query has been computed, it
+// keeps being served while its replacement is computed, even if the
+// replacement fails. Call [PopularQueryUpdater.Run] to also precompute the
+// queries before their time periods roll over.
 type PopularQueryUpdater struct {
 	searcher PostsSearcher
-	periods  [maxTimePeriod]popularQuery
+	opts     PopularQueryUpdaterOptions
+	now      func() time.Time
+	saveMu   sync.Mutex // serializes save
+
+	mu           sync.Mutex
+	utc          *zoneQueries
+	zones        []*zoneQueries // most recently used last
+	lastEviction time.Time
 }
 
 // NewPopularQueryUpdater creates a new PopularQueryUpdater.
 func NewPopularQueryUpdater(searcher PostsSearcher) *PopularQueryUpdater {
-	p := &PopularQueryUpdater{
-		searcher: searcher,
+	return NewPopularQueryUpdaterWithOptions(searcher, PopularQueryUpdaterOptions{})
+}
+
+// NewPopularQueryUpdaterWithOptions creates a new PopularQueryUpdater with the
+// given options.
+func NewPopularQueryUpdaterWithOptions(searcher PostsSearcher, opts PopularQueryUpdaterOptions) *PopularQueryUpdater {
+	if opts.MaxTimezones == 0 {
+		opts.MaxTimezones = DefaultMaxTimezones
+	}
+	if opts.Rules == nil {
+		rules := DefaultPeriodRules
+		opts.Rules = &rules
+	}
+	if opts.Offsets == nil {
+		opts.Offsets = NewOffsetTable()
+	}
+	if opts.TimezoneEvictionInterval == 0 {
+		opts.TimezoneEvictionInterval = DefaultTimezoneEvictionInterval
+	}
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = DefaultRefreshInterval
 	}
-	for i := range p.periods {
-		p.periods[i].period = TimePeriod(i)
+	if opts.RefreshLead == 0 {
+		opts.RefreshLead = DefaultRefreshLead
 	}
-	return p
+	if opts.RefreshTimeout == 0 {
+		opts.RefreshTimeout = DefaultRefreshTimeout
+	}
+	if opts.RefreshBackoff == 0 {
+		opts.RefreshBackoff = DefaultRefreshBackoff
+	}
+	return &PopularQueryUpdater{
+		searcher: searcher,
+		opts:     opts,
+		now:      time.Now,
+		utc:      newZoneQueries(time.UTC),
+	}
+}
+
+// PopularQueryOptions are options for
+// [PopularQueryUpdater.QueryPopularWith].
+type PopularQueryOptions struct {
+	// Period is the time period to query the popular posts for.
+	Period TimePeriod
+	// Timezone is the timezone that the time period's boundaries are
+	// computed in. If nil, then [time.UTC] is used.
+	Timezone *time.Location
+	// Base, if not empty, is a query that the popular posts must also match,
+	// such as a character tag. The time period's boundary is estimated over
+	// all posts, so it is shared by every base query.
+	Base query.Query
+	// Rating, if not empty, only includes posts with the given rating. Like
+	// Base, the time period's boundary is shared by every rating.
+	Rating hypnohub.Rating
+}
+
+// PopularQueryResult is the result of
+// [PopularQueryUpdater.QueryPopularWith].
+type PopularQueryResult struct {
+	// Query is the query for the popular posts.
+	Query query.Query
+	// Since is the time that the time period starts at.
+	Since time.Time
+	// UpdatedAt is the time that the query was computed at.
+	UpdatedAt time.Time
+	// Stale is true if the time period has rolled over since the query was
+	// computed. The query is still being served while a new one is computed
+	// in the background.
+	Stale bool
+}
+
+// Age returns how long ago the query was computed.
+func (r *PopularQueryResult) Age() time.Duration {
+	return time.Since(r.UpdatedAt)
 }
 
 // QueryPopular returns the query for the popular posts in the given time period.
 func (p *PopularQueryUpdater) QueryPopular(ctx context.Context, period TimePeriod) (query.Query, error) {
-	if period < 0 || period >= maxTimePeriod {
-		return nil, fmt.Errorf("invalid time period %v", period)
+	r, err := p.QueryPopularWith(ctx, PopularQueryOptions{Period: period})
+	if err != nil {
+		return nil, err
+	}
+	return r.Query, nil
+}
+
+// QueryPopularFor returns the query for the popular posts in the given time
+// period that also match the base query. See [PopularQueryOptions.Base].
+func (p *PopularQueryUpdater) QueryPopularFor(ctx context.Context, period TimePeriod, base query.Query) (query.Query, error) {
+	r, err := p.QueryPopularWith(ctx, PopularQueryOptions{Period: period, Base: base})
+	if err != nil {
+		return nil, err
+	}
+	return r.Query, nil
+}
+
+// QueryPopularWith returns the query for the popular posts using the given
+// options. If the cached query is stale, then it is returned while a new one
+// is computed in the background. The call only waits if no query has been
+// computed yet. If ctx is done while waiting, then ctx.Err() is returned but
+// the computation carries on for later calls. If the computation itself times
+// out, then an error wrapping [ErrRefreshTimeout] is returned. After a failed
+// computation, its error is returned without trying again until
+// [PopularQueryUpdaterOptions.RefreshBackoff] has passed.
+func (p *PopularQueryUpdater) QueryPopularWith(ctx context.Context, opts PopularQueryOptions) (*PopularQueryResult, error) {
+	if !opts.Period.IsValid() {
+		return nil, fmt.Errorf("invalid time period %v", opts.Period)
+	}
+	if opts.Rating != "" && !opts.Rating.IsValid() {
+		return nil, fmt.Errorf("invalid rating %q", opts.Rating)
+	}
+	zone, err := p.zone(opts.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := zone.periods[opts.Period].get(ctx, p, zone.loc)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Query = opts.filter(r.Query)
+	return r, nil
+}
+
+// filter narrows down the popular query using the base query and rating.
+func (opts PopularQueryOptions) filter(q query.Query) query.Query {
+	if len(opts.Base) > 0 {
+		q = query.And(opts.Base, q)
+	}
+	if opts.Rating != "" {
+		q = query.And(query.Rating(opts.Rating), q)
+	}
+	return q
+}
+
+// PopularQueryExplanation is the result of [PopularQueryUpdater.Explain].
+type PopularQueryExplanation struct {
+	// Query is the freshly computed query for the popular posts.
+	Query query.Query
+	// Since is the time that the time period starts at.
+	Since time.Time
+	// Trace records every search made while estimating the time period's
+	// boundary.
+	Trace *EstimateTrace
+}
+
+// Explain computes the query for the popular posts like QueryPopularWith, but
+// always estimates the time period's boundary from scratch and records how
+// it was estimated. The cached query is neither used nor updated, and the
+// estimate works on copies of the offsets and anchors, so explaining a query
+// never changes how the cached queries are estimated. If the estimate fails,
+// then the explanation is still returned along with the error.
+func (p *PopularQueryUpdater) Explain(ctx context.Context, opts PopularQueryOptions) (*PopularQueryExplanation, error) {
+	if !opts.Period.IsValid() {
+		return nil, fmt.Errorf("invalid time period %v", opts.Period)
+	}
+	if opts.Rating != "" && !opts.Rating.IsValid() {
+		return nil, fmt.Errorf("invalid rating %q", opts.Rating)
+	}
+
+	loc := opts.Timezone
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	now := p.now().In(loc)
+	explanation := &PopularQueryExplanation{
+		Since: p.opts.Rules.EarliestTimestamp(now, opts.Period),
+		Trace: &EstimateTrace{},
+	}
+
+	estimateOpts := p.estimateOptions(now)
+	estimateOpts.Period = opts.Period
+	estimateOpts.Trace = explanation.Trace
+	estimateOpts.Offsets = estimateOpts.Offsets.clone()
+	if estimateOpts.Anchors != nil {
+		estimateOpts.Anchors = estimateOpts.Anchors.clone()
+	}
+
+	postID, err := EstimatePostHistory(ctx, p.searcher, estimateOpts)
+	if err != nil {
+		return explanation, err
 	}
-	return p.periods[period].update(ctx, p.searcher)
+
+	explanation.Query = opts.filter(popularSinceQuery(postID))
+	return explanation, nil
+}
+
+// Run precomputes queries in the background until the context is done. Every
+// [PopularQueryUpdaterOptions.RefreshInterval], it refreshes the cached
+// queries whose time periods have rolled over, and precomputes the queries
+// whose time periods are about to roll over. Only queries that have been
+// requested before are refreshed.
+func (p *PopularQueryUpdater) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		p.refreshAll()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshAll starts refreshing every cached query that needs it. Refreshes
+// of the same timezone at the same time are estimated together using
+// [EstimatePostBatch], so that the time periods share the pages they search.
+func (p *PopularQueryUpdater) refreshAll() {
+	p.mu.Lock()
+	zones := append([]*zoneQueries{p.utc}, p.zones...)
+	p.mu.Unlock()
+
+	// Every query is refreshed as of the same time, so that the ones that
+	// rolled over can share a batch.
+	now := p.now()
+
+	for _, zone := range zones {
+		var batches [][]*pendingRefresh
+		for i := range zone.periods {
+			r := zone.periods[i].refreshAhead(p, now.In(zone.loc))
+			if r == nil {
+				continue
+			}
+
+			j := slices.IndexFunc(batches, func(batch []*pendingRefresh) bool {
+				return batch[0].now.Equal(r.now)
+			})
+			if j == -1 {
+				batches = append(batches, []*pendingRefresh{r})
+			} else {
+				batches[j] = append(batches[j], r)
+			}
+		}
+
+		for _, batch := range batches {
+			go p.runRefreshes(batch)
+		}
+	}
+}
+
+// zone returns the cached queries for the given timezone, creating them if
+// needed. If that needs evicting another timezone too soon after the last
+// eviction, then [ErrTooManyTimezones] is returned.
+func (p *PopularQueryUpdater) zone(loc *time.Location) (*zoneQueries, error) {
+	if loc == nil || loc.String() == time.UTC.String() {
+		return p.utc, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := slices.IndexFunc(p.zones, func(z *zoneQueries) bool {
+		return z.loc.String() == loc.String()
+	})
+
+	var z *zoneQueries
+	if i == -1 {
+		if len(p.zones) >= p.opts.MaxTimezones {
+			now := p.now()
+			if p.opts.TimezoneEvictionInterval > 0 && now.Sub(p.lastEviction) < p.opts.TimezoneEvictionInterval {
+				return nil, ErrTooManyTimezones
+			}
+			// Evict the least recently used timezone.
+			p.zones = slices.Delete(p.zones, 0, len(p.zones)-p.opts.MaxTimezones+1)
+			p.lastEviction = now
+		}
+		z = newZoneQueries(loc)
+	} else {
+		z = p.zones[i]
+		p.zones = slices.Delete(p.zones, i, i+1)
+	}
+
+	p.zones = append(p.zones, z)
+	return z, nil
+}
+
+// zoneQueries contains the queries for each time period in a single timezone.
+type zoneQueries struct {
+	loc     *time.Location
+	periods [maxTimePeriod]popularQuery
+}
+
+func newZoneQueries(loc *time.Location) *zoneQueries {
+	z := &zoneQueries{loc: loc}
+	for i := range z.periods {
+		z.periods[i].period = TimePeriod(i)
+	}
+	return z
 }
 
 type popularQuery struct {
-	mu    sync.Mutex
-	query query.Query
-	last  time.Time
+	mu       sync.Mutex
+	current  popularEntry
+	next     popularEntry  // precomputed for the next time period
+	err      error         // error of the last refresh
+	failedAt time.Time     // time that the last refresh failed at
+	done     chan struct{} // closed once the ongoing refresh is done, or nil
 
 	period TimePeriod // constant
 }
 
-func (q *popularQuery) update(ctx context.Context, searcher PostsSearcher) (query.Query, error) {
-	now := time.Now().UTC()
-	earliest := EarliestTimestampForPeriod(now, q.period)
+// popularEntry is a computed query.
+type popularEntry struct {
+	query     query.Query
+	since     time.Time
+	updatedAt time.Time
+}
+
+func (e popularEntry) result(stale bool) *PopularQueryResult {
+	return &PopularQueryResult{
+		Query:     e.query,
+		Since:     e.since,
+		UpdatedAt: e.updatedAt,
+		Stale:     stale,
+	}
+}
+
+// get returns the query for the current time period, refreshing it if needed.
+func (q *popularQuery) get(ctx context.Context, p *PopularQueryUpdater, loc *time.Location) (*PopularQueryResult, error) {
+	now := p.now().In(loc)
+	earliest := p.opts.Rules.EarliestTimestamp(now, q.period)
+
+	q.mu.Lock()
+
+	q.promote(earliest)
+	if q.current.query != nil && q.current.since.Equal(earliest) {
+		defer q.mu.Unlock()
+		return q.current.result(false), nil
+	}
+
+	done := q.refresh(p, now, earliest)
+	if q.current.query != nil {
+		defer q.mu.Unlock()
+		return q.current.result(true), nil
+	}
+	if done == nil {
+		// The last refresh failed too recently to try again.
+		defer q.mu.Unlock()
+		return nil, q.err
+	}
+
+	q.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.current.query == nil {
+		if q.err == nil {
+			return nil, fmt.Errorf("popular query for %v was not computed", q.period)
+		}
+		return nil, q.err
+	}
+	return q.current.result(!q.current.since.Equal(earliest)), nil
+}
+
+// refreshAhead starts refreshing the query if its time period has rolled
+// over, or precomputes the next query if the time period is about to roll
+// over, as of the given time. The query is left alone if it has never been
+// requested. The started refresh is returned for the caller to run, or nil if
+// none was started.
+func (q *popularQuery) refreshAhead(p *PopularQueryUpdater, now time.Time) *pendingRefresh {
+	earliest := p.opts.Rules.EarliestTimestamp(now, q.period)
 
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	if q.last.Equal(earliest) {
-		return q.query, nil
+	if q.current.query == nil {
+		return nil
 	}
 
-	query, err := fetchQueryForPeriod(ctx, searcher, now, q.period)
+	q.promote(earliest)
+	if !q.current.since.Equal(earliest) {
+		r, _ := q.startRefresh(p, now, earliest)
+		return r
+	}
+
+	boundary := p.opts.Rules.NextBoundary(now, q.period)
+	if boundary.IsZero() || boundary.Sub(now) > p.opts.RefreshLead {
+		return nil
+	}
+
+	// The next query can only be computed ahead of time if the next time
+	// period starts in the past, since its posts already exist.
+	next := p.opts.Rules.EarliestTimestamp(boundary, q.period)
+	if next.After(now) || q.next.query != nil && q.next.since.Equal(next) {
+		return nil
+	}
+
+	r, _ := q.startRefresh(p, boundary, next)
+	return r
+}
+
+// promote makes the precomputed query current once its time period has
+// started. q.mu must be held.
+func (q *popularQuery) promote(earliest time.Time) {
+	if q.next.query != nil && q.next.since.Equal(earliest) {
+		q.current = q.next
+		q.next = popularEntry{}
+	}
+}
+
+// refresh starts computing the query for the time period at the given time in
+// the background, unless a refresh is already ongoing. It returns a channel
+// that is closed once the refresh is done, or nil if the last refresh failed
+// less than [PopularQueryUpdaterOptions.RefreshBackoff] ago. q.mu must be
+// held.
+func (q *popularQuery) refresh(p *PopularQueryUpdater, now, since time.Time) <-chan struct{} {
+	r, done := q.startRefresh(p, now, since)
+	if r != nil {
+		go p.runRefreshes([]*pendingRefresh{r})
+	}
+	return done
+}
+
+// pendingRefresh is a refresh that has been started but not computed yet.
+type pendingRefresh struct {
+	q     *popularQuery
+	now   time.Time
+	since time.Time
+	done  chan struct{}
+}
+
+// startRefresh marks the query as being refreshed like refresh, but leaves
+// running the returned refresh to the caller. If a refresh is already ongoing
+// or the backoff has not passed yet, then no refresh is returned. q.mu must
+// be held.
+func (q *popularQuery) startRefresh(p *PopularQueryUpdater, now, since time.Time) (*pendingRefresh, <-chan struct{}) {
+	if q.done != nil {
+		return nil, q.done
+	}
+	if q.err != nil && p.now().Sub(q.failedAt) < p.opts.RefreshBackoff {
+		return nil, nil
+	}
+
+	done := make(chan struct{})
+	q.done = done
+
+	return &pendingRefresh{q: q, now: now, since: since, done: done}, done
+}
+
+// runRefreshes computes the queries of the given refreshes, which must all be
+// at the same time, and stores them.
+func (p *PopularQueryUpdater) runRefreshes(refreshes []*pendingRefresh) {
+	// Intentionally use the background context so that the refresh is never
+	// interrupted by whoever started it. Everyone waiting for it may stop
+	// waiting on their own.
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.RefreshTimeout)
+	defer cancel()
+
+	now := refreshes[0].now
+	periods := make([]TimePeriod, len(refreshes))
+	for i, r := range refreshes {
+		periods[i] = r.q.period
+	}
+
+	queries, err := p.fetchQueries(ctx, now, periods)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %v: %w", ErrRefreshTimeout, p.opts.RefreshTimeout, err)
+	}
+
+	var replaced bool
+	for _, r := range refreshes {
+		if r.q.finishRefresh(p, now.Location(), r.since, queries[r.q.period], err) {
+			replaced = true
+		}
+		close(r.done)
+	}
+	if replaced {
+		p.save()
+	}
+}
+
+// finishRefresh stores the result of a refresh started by refresh. It returns
+// true if the current query was replaced.
+func (q *popularQuery) finishRefresh(p *PopularQueryUpdater, loc *time.Location, since time.Time, query query.Query, err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.done = nil
+	q.err = err
+
 	if err != nil {
-		return nil, err
+		q.failedAt = p.now()
+		slog.Warn(
+			"cannot refresh popular query",
+			"period", q.period,
+			"timezone", loc.String(),
+			"err", err)
+		return false
+	}
+
+	entry := popularEntry{
+		query:     query,
+		since:     since,
+		updatedAt: p.now(),
+	}
+
+	earliest := p.opts.Rules.EarliestTimestamp(p.now().In(loc), q.period)
+	switch {
+	case since.After(earliest):
+		q.next = entry
+		return false
+	case q.current.query == nil || !since.Before(q.current.since):
+		q.current = entry
+		return true
+	default:
+		return false
 	}
+}
+
+func (p *PopularQueryUpdater) fetchQuery(ctx context.Context, now time.Time, period TimePeriod) (query.Query, error) {
+	opts := p.estimateOptions(now)
+	opts.Period = period
 
-	q.query = query
-	q.last = earliest
-	return query, nil
+	postID, err := EstimatePostHistory(ctx, p.searcher, opts)
+	if err != nil {
+		return nil, err
+	}
+	return popularSinceQuery(postID), nil
 }
 
-func fetchQueryForPeriod(ctx context.Context, searcher PostsSearcher, now time.Time, period TimePeriod) (query.Query, error) {
-	postID, err := EstimatePostHistory(ctx, searcher, EstimatePostOptions{
-		Now:    now,
-		Period: period,
+// fetchQueries computes the queries of several time periods at once. See
+// [EstimatePostBatch].
+func (p *PopularQueryUpdater) fetchQueries(ctx context.Context, now time.Time, periods []TimePeriod) (map[TimePeriod]query.Query, error) {
+	if len(periods) == 1 {
+		q, err := p.fetchQuery(ctx, now, periods[0])
+		if err != nil {
+			return nil, err
+		}
+		return map[TimePeriod]query.Query{periods[0]: q}, nil
+	}
+
+	postIDs, err := EstimatePostBatch(ctx, p.searcher, BatchEstimateOptions{
+		EstimatePostOptions: p.estimateOptions(now),
+		Periods:             periods,
 	})
 	if err != nil {
 		return nil, err
 	}
+
+	queries := make(map[TimePeriod]query.Query, len(postIDs))
+	for period, postID := range postIDs {
+		queries[period] = popularSinceQuery(postID)
+	}
+	return queries, nil
+}
+
+func (p *PopularQueryUpdater) estimateOptions(now time.Time) EstimatePostOptions {
+	return EstimatePostOptions{
+		Now:      now,
+		Timezone: now.Location(),
+		Rules:    p.opts.Rules,
+		Offsets:  p.opts.Offsets,
+		Method:   p.opts.Method,
+		Anchors:  p.opts.Anchors,
+		Status:   p.opts.Status,
+	}
+}
+
+// popularSinceQuery returns the query for the most popular posts from the
+// given post onwards.
+func popularSinceQuery(postID hypnohub.PostID) query.Query {
 	return query.And(
 		query.Sort(query.SortScore, query.SortDescending),
-		query.ID(query.GreaterEqual, postID),
-	), nil
+		PostIDRange{Lower: postID}.Query(),
+	)
 }
@@ -0,0 +1,568 @@
+package popular
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/query"
+)
+
+func TestPopularQueryUpdaterTimezones(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 30, 0, 0, time.UTC)
+	searcher := NewCountingSearcher(newPostsSearcher(weekPosts(now)))
+
+	updater := NewPopularQueryUpdaterWithOptions(searcher, PopularQueryUpdaterOptions{
+		MaxTimezones: 1,
+	})
+	updater.now = func() time.Time { return now }
+
+	for _, name := range []string{"Europe/Berlin", "Asia/Tokyo", "Asia/Tokyo"} {
+		loc := mustLoadLocation(name)
+
+		r, err := updater.QueryPopularWith(context.Background(), PopularQueryOptions{
+			Period:   Daily,
+			Timezone: loc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		since := EarliestTimestampForPeriod(now.In(loc), Daily)
+		if !r.Since.Equal(since) || r.Since.Location().String() != name {
+			t.Errorf("%s: expected period to start at %v, got %v", name, since, r.Since)
+		}
+	}
+
+	if len(updater.zones) != 1 || updater.zones[0].loc.String() != "Asia/Tokyo" {
+		t.Errorf("expected only Asia/Tokyo to be cached, got %d zones", len(updater.zones))
+	}
+
+	counter := searcher.Count()
+	if _, err := updater.QueryPopularWith(context.Background(), PopularQueryOptions{
+		Period:   Daily,
+		Timezone: mustLoadLocation("Asia/Tokyo"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if searcher.Count() != counter {
+		t.Errorf("expected cached query to not search, got %d new searches", searcher.Count()-counter)
+	}
+
+	// Asia/Tokyo evicted Europe/Berlin just now, so another new timezone
+	// has to wait.
+	newYork := PopularQueryOptions{
+		Period:   Daily,
+		Timezone: mustLoadLocation("America/New_York"),
+	}
+	if _, err := updater.QueryPopularWith(context.Background(), newYork); !errors.Is(err, ErrTooManyTimezones) {
+		t.Fatalf("expected ErrTooManyTimezones, got %v", err)
+	}
+	if searcher.Count() != counter {
+		t.Errorf("expected rejected timezone to not search, got %d new searches", searcher.Count()-counter)
+	}
+
+	updater.lastEviction = updater.lastEviction.Add(-DefaultTimezoneEvictionInterval)
+	if _, err := updater.QueryPopularWith(context.Background(), newYork); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPopularQueryUpdaterStale(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 30, 0, 0, time.UTC)
+	searcher := NewCountingSearcher(newPostsSearcher(dayPosts(now)))
+
+	updater := NewPopularQueryUpdater(searcher)
+	updater.now = func() time.Time { return now }
+
+	query := func() *PopularQueryResult {
+		t.Helper()
+		r, err := updater.QueryPopularWith(context.Background(), PopularQueryOptions{
+			Period: Last24Hours,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	first := query()
+	if first.Stale || !first.Since.Equal(now.Add(-24*time.Hour-30*time.Minute)) {
+		t.Fatalf("unexpected first result %+v", first)
+	}
+
+	// Roll over to the next hour. The old query is served while a new one is
+	// computed.
+	now = now.Add(time.Hour)
+	stale := query()
+	if !stale.Stale || !stale.Since.Equal(first.Since) {
+		t.Fatalf("expected stale result, got %+v", stale)
+	}
+
+	waitRefresh(&updater.utc.periods[Last24Hours])
+
+	fresh := query()
+	if fresh.Stale || !fresh.Since.Equal(first.Since.Add(time.Hour)) {
+		t.Fatalf("expected fresh result, got %+v", fresh)
+	}
+}
+
+func TestPopularQueryUpdaterPrecompute(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 58, 0, 0, time.UTC)
+	searcher := NewCountingSearcher(newPostsSearcher(dayPosts(now)))
+
+	updater := NewPopularQueryUpdater(searcher)
+	updater.now = func() time.Time { return now }
+
+	if _, err := updater.QueryPopular(context.Background(), Last24Hours); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hour rolls over in 2 minutes, which is within the lead time.
+	updater.refreshAll()
+	waitRefresh(&updater.utc.periods[Last24Hours])
+
+	counter := searcher.Count()
+	now = now.Add(5 * time.Minute)
+
+	r, err := updater.QueryPopularWith(context.Background(), PopularQueryOptions{
+		Period: Last24Hours,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Stale || !r.Since.Equal(time.Date(2024, time.January, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected precomputed result, got %+v", r)
+	}
+	if searcher.Count() != counter {
+		t.Errorf("expected precomputed query to not search, got %d new searches", searcher.Count()-counter)
+	}
+}
+
+func TestPopularQueryUpdaterBatch(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC)
+
+	var posts []mockPost
+	for i := 0; i < 100; i++ {
+		posts = append(posts, mockPost{
+			ID:   hypnohub.PostID(1000 - i),
+			Time: now.Add(12*time.Hour - time.Duration(i)*time.Hour),
+		})
+	}
+	searcher := newPostsSearcher(posts)
+
+	var mu sync.Mutex
+	var fetched map[cachedSearchKey]int
+	updater := NewPopularQueryUpdater(PostsSearcherFunc(func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+		mu.Lock()
+		fetched[cachedSearchKey{query, postOffset}]++
+		mu.Unlock()
+		return searcher.SearchPosts(ctx, query, postOffset)
+	}))
+	// The clock keeps ticking between every call, like the real one.
+	var clockMu sync.Mutex
+	updater.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	periods := []TimePeriod{Daily, DailyYesterday}
+
+	fetched = make(map[cachedSearchKey]int)
+	for _, period := range periods {
+		if _, err := updater.QueryPopular(context.Background(), period); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both days roll over at midnight, so they are refreshed together and
+	// every page is only searched once.
+	clockMu.Lock()
+	now = now.Add(12*time.Hour + time.Minute)
+	clockMu.Unlock()
+
+	mu.Lock()
+	fetched = make(map[cachedSearchKey]int)
+	mu.Unlock()
+
+	updater.refreshAll()
+	for _, period := range periods {
+		waitRefresh(&updater.utc.periods[period])
+	}
+
+	for _, period := range periods {
+		r, err := updater.QueryPopularWith(context.Background(), PopularQueryOptions{Period: period})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Stale {
+			t.Errorf("%v: expected refreshed result, got %+v", period, r)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key, n := range fetched {
+		if n > 1 {
+			t.Errorf("expected page %q at offset %d to be searched once, got %d", key.query, key.offset, n)
+		}
+	}
+}
+
+func TestPopularQueryUpdaterExplain(t *testing.T) {
+	now := testDate("01-02-2020 21:00")
+
+	var posts []mockPost
+	for i := 0; i < 20; i++ {
+		posts = append(posts, mockPost{
+			ID:   hypnohub.PostID(2000 - i),
+			Time: now.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+
+	// The table is too small for the last 24 hours, so estimating them
+	// would learn a larger offset.
+	offsets := NewOffsetTable()
+	if err := json.Unmarshal([]byte(`{"last-24-hours": 4}`), offsets); err != nil {
+		t.Fatal(err)
+	}
+	anchors := NewAnchorStore()
+
+	updater := NewPopularQueryUpdaterWithOptions(newPostsSearcher(posts), PopularQueryUpdaterOptions{
+		Offsets: offsets,
+		Anchors: anchors,
+	})
+	updater.now = func() time.Time { return now }
+
+	explanation, err := updater.Explain(context.Background(), PopularQueryOptions{Period: Last24Hours})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(explanation.Trace.Probes()) == 0 {
+		t.Errorf("expected the explanation to record its searches")
+	}
+
+	if offset := offsets.MaxOffset(Last24Hours); offset != 4 {
+		t.Errorf("expected explaining to not learn offsets, got %d", offset)
+	}
+	if n := anchors.Len(); n != 0 {
+		t.Errorf("expected explaining to not record anchors, got %d", n)
+	}
+}
+
+// weekPosts returns posts made now, 3 days ago and 6 days ago, which are all
+// within the last week.
+func weekPosts(now time.Time) []mockPost {
+	return []mockPost{
+		{3, now},
+		{2, now.AddDate(0, 0, -3)},
+		{1, now.AddDate(0, 0, -6)},
+	}
+}
+
+// dayPosts returns posts made 1, 12 and 48 hours before now, so that only the
+// first two are within the last 24 hours.
+func dayPosts(now time.Time) []mockPost {
+	return []mockPost{
+		{3, now.Add(-time.Hour)},
+		{2, now.Add(-12 * time.Hour)},
+		{1, now.Add(-48 * time.Hour)},
+	}
+}
+
+// waitRefresh waits until the query is no longer being refreshed.
+func waitRefresh(q *popularQuery) {
+	q.mu.Lock()
+	done := q.done
+	q.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func TestPopularQueryUpdaterRestore(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 30, 0, 0, time.UTC)
+	searcher := NewCountingSearcher(newPostsSearcher(dayPosts(now)))
+
+	store := NewFilePopularQueryStore(filepath.Join(t.TempDir(), "popular.json"))
+	opts := PopularQueryUpdaterOptions{Store: store}
+
+	updater := NewPopularQueryUpdaterWithOptions(searcher, opts)
+	updater.now = func() time.Time { return now }
+
+	for _, period := range []TimePeriod{Daily, Last24Hours} {
+		if _, err := updater.QueryPopular(context.Background(), period); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An hour later, the daily query is still valid, but the last 24 hours
+	// have moved.
+	now = now.Add(time.Hour)
+
+	restored := NewPopularQueryUpdaterWithOptions(searcher, opts)
+	restored.now = func() time.Time { return now }
+	if err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := searcher.Count()
+	r, err := restored.QueryPopularWith(context.Background(), PopularQueryOptions{Period: Daily})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Stale || !r.Since.Equal(EarliestTimestampForPeriod(now, Daily)) {
+		t.Errorf("unexpected restored daily result %+v", r)
+	}
+	if searcher.Count() != counter {
+		t.Errorf("expected restored query to not search, got %d new searches", searcher.Count()-counter)
+	}
+
+	if restored.utc.periods[Last24Hours].current.query != nil {
+		t.Errorf("expected outdated last 24 hours query to be dropped")
+	}
+}
+
+func TestPopularQueryUpdaterRestoreTimezones(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 30, 0, 0, time.UTC)
+	berlin := mustLoadLocation("Europe/Berlin")
+	tokyo := mustLoadLocation("Asia/Tokyo")
+
+	store := NewFilePopularQueryStore(filepath.Join(t.TempDir(), "popular.json"))
+	if err := store.SavePopularQueries([]StoredPopularQuery{
+		{
+			Period:   Daily,
+			Timezone: berlin.String(),
+			Query:    query.Tag("outdated"),
+			Since:    EarliestTimestampForPeriod(now.In(berlin), Daily).AddDate(0, 0, -1),
+		},
+		{
+			Period:   Daily,
+			Timezone: tokyo.String(),
+			Query:    query.Tag("current"),
+			Since:    EarliestTimestampForPeriod(now.In(tokyo), Daily),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	updater := NewPopularQueryUpdaterWithOptions(newPostsSearcher(nil), PopularQueryUpdaterOptions{
+		Store:        store,
+		MaxTimezones: 1,
+	})
+	updater.now = func() time.Time { return now }
+	if err := updater.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The outdated query must not take up the only timezone.
+	if len(updater.zones) != 1 || updater.zones[0].loc.String() != tokyo.String() {
+		t.Fatalf("expected only Asia/Tokyo to be cached, got %d zones", len(updater.zones))
+	}
+	if q := updater.zones[0].periods[Daily].current.query; q.String() != "current" {
+		t.Errorf("expected the current query to be restored, got %q", q)
+	}
+}
+
+func TestPopularQueryUpdaterFilter(t *testing.T) {
+	searcher := NewCountingSearcher(newPostsSearcher(weekPosts(time.Now())))
+	updater := NewPopularQueryUpdater(searcher)
+
+	all, err := updater.QueryPopular(context.Background(), Weekly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   PopularQueryOptions
+		filter query.Query
+	}{
+		{
+			name:   "base",
+			opts:   PopularQueryOptions{Base: query.Tag("spiral_eyes")},
+			filter: query.Tag("spiral_eyes"),
+		},
+		{
+			name:   "other base",
+			opts:   PopularQueryOptions{Base: query.Tag("pendulum")},
+			filter: query.Tag("pendulum"),
+		},
+		{
+			name:   "safe",
+			opts:   PopularQueryOptions{Rating: hypnohub.RatingSafe},
+			filter: query.Rating(hypnohub.RatingSafe),
+		},
+		{
+			name:   "explicit",
+			opts:   PopularQueryOptions{Rating: hypnohub.RatingExplicit},
+			filter: query.Rating(hypnohub.RatingExplicit),
+		},
+		{
+			name: "base and rating",
+			opts: PopularQueryOptions{
+				Base:   query.Tag("pendulum"),
+				Rating: hypnohub.RatingSafe,
+			},
+			filter: query.And(query.Rating(hypnohub.RatingSafe), query.Tag("pendulum")),
+		},
+	}
+
+	counter := searcher.Count()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Period = Weekly
+
+			r, err := updater.QueryPopularWith(context.Background(), test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expect := query.And(test.filter, all).String()
+			if r.Query.String() != expect {
+				t.Errorf("expected %q, got %q", expect, r.Query)
+			}
+		})
+	}
+	if searcher.Count() != counter {
+		t.Errorf("expected filters to share the estimate, got %d new searches", searcher.Count()-counter)
+	}
+
+	if _, err := updater.QueryPopularWith(context.Background(), PopularQueryOptions{
+		Period: Weekly,
+		Rating: "spicy",
+	}); err == nil {
+		t.Errorf("expected unknown rating to fail")
+	}
+}
+
+func TestPopularQueryUpdaterRatingsIndependent(t *testing.T) {
+	updater := NewPopularQueryUpdater(newPostsSearcher(weekPosts(time.Now())))
+
+	queryRating := func(rating hypnohub.Rating) string {
+		t.Helper()
+		r, err := updater.QueryPopularWith(context.Background(), PopularQueryOptions{
+			Period: Weekly,
+			Rating: rating,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Query.String()
+	}
+
+	all := queryRating("")
+	safe := queryRating(hypnohub.RatingSafe)
+	explicit := queryRating(hypnohub.RatingExplicit)
+
+	// Filtering by one rating must not leak into the cached query that
+	// every other rating is built from.
+	if strings.Contains(explicit, "rating:safe") {
+		t.Errorf("expected explicit query to not include the safe rating, got %q", explicit)
+	}
+	if again := queryRating(hypnohub.RatingSafe); again != safe {
+		t.Errorf("expected safe query %q to be unchanged, got %q", safe, again)
+	}
+	if again := queryRating(""); again != all {
+		t.Errorf("expected unfiltered query %q to be unchanged, got %q", all, again)
+	}
+}
+
+func TestPopularQueryUpdaterBackoff(t *testing.T) {
+	now := time.Now()
+	counter := NewCountingSearcher(newPostsSearcher(dayPosts(now)))
+
+	var down atomic.Bool
+	down.Store(true)
+	faulty := NewFaultySearcher(counter, FaultOptions{
+		Match: func(query string, postOffset int) bool { return down.Load() },
+	})
+
+	updater := NewPopularQueryUpdater(faulty)
+	updater.now = func() time.Time { return now }
+
+	// Hypnohub is down, so the first refresh fails.
+	if _, err := updater.QueryPopular(context.Background(), Daily); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("expected injected fault, got %v", err)
+	}
+	searches := faulty.count.Load()
+
+	for i := 0; i < 3; i++ {
+		if _, err := updater.QueryPopular(context.Background(), Daily); !errors.Is(err, ErrInjectedFault) {
+			t.Fatalf("expected the failed refresh's error, got %v", err)
+		}
+	}
+	if n := faulty.count.Load(); n != searches {
+		t.Errorf("expected no searches during the backoff, got %d", n-searches)
+	}
+
+	// Once the backoff has passed and hypnohub is back up, the query is
+	// computed again.
+	down.Store(false)
+	now = now.Add(DefaultRefreshBackoff)
+	if _, err := updater.QueryPopular(context.Background(), Daily); err != nil {
+		t.Fatal(err)
+	}
+	if counter.Count() == 0 {
+		t.Error("expected the query to be computed after the backoff")
+	}
+}
+
+func TestPopularQueryUpdaterTimeout(t *testing.T) {
+	// Every search hangs until its context is done, and reports why it was
+	// stopped.
+	started := make(chan struct{}, 1)
+	searcher := NewCountingSearcher(PostsSearcherFunc(func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}))
+
+	updater := NewPopularQueryUpdaterWithOptions(searcher, PopularQueryUpdaterOptions{
+		RefreshTimeout: 50 * time.Millisecond,
+	})
+
+	// A waiter that gives up once the search has started does not cancel
+	// the refresh.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := updater.QueryPopular(ctx, Daily)
+		errc <- err
+	}()
+
+	<-started
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) || errors.Is(err, ErrRefreshTimeout) {
+		t.Fatalf("expected the waiter to be cancelled, got %v", err)
+	}
+
+	// Waiting for the same refresh eventually hits its own timeout, which is
+	// what stops the search rather than the waiter.
+	_, err := updater.QueryPopular(context.Background(), Daily)
+	if !errors.Is(err, ErrRefreshTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected refresh timeout, got %v", err)
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("expected the refresh to carry on after the waiter gave up, got %v", err)
+	}
+	if searcher.Errors() == 0 {
+		t.Errorf("expected the refresh's search to be stopped")
+	}
+}
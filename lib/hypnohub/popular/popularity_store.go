@@ -0,0 +1,193 @@
+package popular
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub/query"
+)
+
+// StoredPopularQuery is a computed popular query as saved by a
+// [PopularQueryStore].
+type StoredPopularQuery struct {
+	// Period is the time period of the query.
+	Period TimePeriod `json:"period"`
+	// Timezone is the name of the timezone that the time period's boundaries
+	// were computed in.
+	Timezone string `json:"timezone"`
+	// Query is the computed query.
+	Query query.Query `json:"query"`
+	// Since is the time that the time period starts at.
+	Since time.Time `json:"since"`
+	// UpdatedAt is the time that the query was computed at.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PopularQueryStore persists the queries of a [PopularQueryUpdater] so that
+// they survive restarts.
+type PopularQueryStore interface {
+	// LoadPopularQueries loads the saved queries. It returns no queries if
+	// nothing has been saved yet.
+	LoadPopularQueries() ([]StoredPopularQuery, error)
+	// SavePopularQueries replaces the saved queries with the given ones.
+	SavePopularQueries([]StoredPopularQuery) error
+}
+
+// FilePopularQueryStore is a [PopularQueryStore] that saves queries to a JSON
+// file.
+type FilePopularQueryStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+var _ PopularQueryStore = (*FilePopularQueryStore)(nil)
+
+// NewFilePopularQueryStore creates a new FilePopularQueryStore that saves to
+// the given path.
+func NewFilePopularQueryStore(path string) *FilePopularQueryStore {
+	return &FilePopularQueryStore{path: path}
+}
+
+// LoadPopularQueries implements [PopularQueryStore].
+func (s *FilePopularQueryStore) LoadPopularQueries() ([]StoredPopularQuery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var queries []StoredPopularQuery
+	if err := json.Unmarshal(b, &queries); err != nil {
+		return nil, fmt.Errorf("parsing popular queries %s: %w", s.path, err)
+	}
+	return queries, nil
+}
+
+// SavePopularQueries implements [PopularQueryStore].
+func (s *FilePopularQueryStore) SavePopularQueries(queries []StoredPopularQuery) error {
+	b, err := json.MarshalIndent(queries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(s.path, b)
+}
+
+// Restore loads the queries saved in [PopularQueryUpdaterOptions.Store].
+// Queries whose time periods have rolled over since they were saved are
+// dropped. It does nothing if there is no store.
+func (p *PopularQueryUpdater) Restore() error {
+	if p.opts.Store == nil {
+		return nil
+	}
+
+	stored, err := p.opts.Store.LoadPopularQueries()
+	if err != nil {
+		return fmt.Errorf("loading popular queries: %w", err)
+	}
+
+	for _, s := range stored {
+		if !s.Period.IsValid() || s.Query == nil {
+			continue
+		}
+
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil || loc == time.Local {
+			slog.Warn(
+				"dropping saved popular query with unknown timezone",
+				"timezone", s.Timezone,
+				"err", err)
+			continue
+		}
+
+		// Check whether the query is outdated before caching its timezone,
+		// so that outdated queries don't use up the timezones.
+		earliest := p.opts.Rules.EarliestTimestamp(p.now().In(loc), s.Period)
+		if !s.Since.Equal(earliest) {
+			slog.Debug(
+				"dropping outdated saved popular query",
+				"period", s.Period,
+				"timezone", s.Timezone,
+				"since", s.Since)
+			continue
+		}
+
+		zone, err := p.zone(loc)
+		if err != nil {
+			slog.Warn(
+				"dropping saved popular query",
+				"timezone", s.Timezone,
+				"err", err)
+			continue
+		}
+		q := &zone.periods[s.Period]
+
+		q.mu.Lock()
+		if q.current.query == nil {
+			q.current = popularEntry{
+				query:     s.Query,
+				since:     s.Since.In(zone.loc),
+				updatedAt: s.UpdatedAt,
+			}
+		}
+		q.mu.Unlock()
+	}
+
+	return nil
+}
+
+// save saves the current queries to [PopularQueryUpdaterOptions.Store]. It
+// does nothing if there is no store.
+func (p *PopularQueryUpdater) save() {
+	if p.opts.Store == nil {
+		return
+	}
+
+	// Concurrent saves are serialized from the snapshot to the write, so
+	// that an older snapshot can never overwrite a newer one.
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	p.mu.Lock()
+	zones := append([]*zoneQueries{p.utc}, p.zones...)
+	p.mu.Unlock()
+
+	var stored []StoredPopularQuery
+	for _, zone := range zones {
+		for i := range zone.periods {
+			q := &zone.periods[i]
+
+			q.mu.Lock()
+			if q.current.query != nil {
+				stored = append(stored, StoredPopularQuery{
+					Period:    q.period,
+					Timezone:  zone.loc.String(),
+					Query:     q.current.query,
+					Since:     q.current.since,
+					UpdatedAt: q.current.updatedAt,
+				})
+			}
+			q.mu.Unlock()
+		}
+	}
+
+	if err := p.opts.Store.SavePopularQueries(stored); err != nil {
+		slog.Warn(
+			"cannot save popular queries",
+			"err", err)
+	}
+}
@@ -4,8 +4,39 @@ import (
 	"time"
 )
 
+// PeriodRules are the rules that decide when each calendar-aligned time
+// period starts. Different deployments may want different rules, for example
+// to start weeks on Sunday.
+type PeriodRules struct {
+	// WeekStart is the first day of the week.
+	WeekStart time.Weekday
+	// WeekCarryOverDays is the number of days into the current week during
+	// which posts from last week are still included.
+	WeekCarryOverDays int
+	// MonthCarryOverDays is the number of days into the current month during
+	// which posts from last month are still included.
+	MonthCarryOverDays int
+	// YearCarryOverDays is the number of days into the current year during
+	// which posts from last year are still included.
+	YearCarryOverDays int
+	// IncludeYesterday is whether the daily time periods also include the
+	// day before them.
+	IncludeYesterday bool
+}
+
+// DefaultPeriodRules are the default rules used by
+// [EarliestTimestampForPeriod].
+var DefaultPeriodRules = PeriodRules{
+	WeekStart:          time.Monday,
+	WeekCarryOverDays:  6,
+	MonthCarryOverDays: 14,
+	YearCarryOverDays:  31,
+	IncludeYesterday:   true,
+}
+
 // EarliestTimestampForPeriod returns the earliest timestamp for the given
-// time period. If now is zero, then [time.Now] is used.
+// time period using [DefaultPeriodRules]. If now is zero, then [time.Now] is
+// used.
 //
 // For each time period:
 //   - Day: posts that were created yesterday are also included.
@@ -14,32 +45,144 @@ import (
 //     included.
 //   - Month: posts made from last month are included as well, unless we're
 //     over two weeks into the current month.
+//   - Year: posts made from last year are included as well, unless we're
+//     past January.
+//   - All time: the zero time is returned.
+//   - Last 24 hours, 7 days and 30 days: posts made within the window are
+//     included. The window ends at the start of the current hour, so it only
+//     moves once an hour. 24 hours is always exactly 24 hours, while days
+//     are calendar days, so they may be 23 or 25 hours long around daylight
+//     saving time changes.
 func EarliestTimestampForPeriod(now time.Time, period TimePeriod) time.Time {
+	return DefaultPeriodRules.EarliestTimestamp(now, period)
+}
+
+// EarliestTimestamp returns the earliest timestamp for the given time period
+// using the rules. If now is zero, then [time.Now] is used. See
+// [EarliestTimestampForPeriod] for how each time period is treated.
+func (r PeriodRules) EarliestTimestamp(now time.Time, period TimePeriod) time.Time {
 	now = initNow(now)
 	early := now
+
+	var extraDays int
+	if r.IncludeYesterday {
+		extraDays = 1
+	}
+
 	switch period {
 	case Daily:
-		early = truncateDay(early).AddDate(0, 0, -1)
+		early = truncateDay(early).AddDate(0, 0, -extraDays)
 	case DailyYesterday:
-		early = truncateDay(early).AddDate(0, 0, -2)
+		early = truncateDay(early).AddDate(0, 0, -1-extraDays)
 	case Weekly:
-		early = truncateWeek(early)
-		if now.Weekday() != time.Sunday {
+		early = truncateWeek(early, r.WeekStart)
+		if daysBetween(early, now) < r.WeekCarryOverDays {
 			// Push this back another week.
 			early = early.AddDate(0, 0, -7)
 		}
 	case Monthly:
 		early = truncateMonth(early)
-		if now.Day() <= 14 {
+		if daysBetween(early, now) < r.MonthCarryOverDays {
 			// Push this back another month.
 			early = early.AddDate(0, -1, 0)
 		}
+	case Yearly:
+		early = truncateYear(early)
+		if daysBetween(early, now) < r.YearCarryOverDays {
+			// Push this back another year.
+			early = early.AddDate(-1, 0, 0)
+		}
+	case AllTime:
+		early = time.Time{}
+	case Last24Hours:
+		early = truncateHour(early).Add(-24 * time.Hour)
+	case Last7Days:
+		early = truncateHour(early).AddDate(0, 0, -7)
+	case Last30Days:
+		early = truncateHour(early).AddDate(0, 0, -30)
 	default:
 		panic("invalid period")
 	}
 	return early
 }
 
+// maxBoundaryDays is the maximum number of days that NextBoundary looks ahead.
+// It is long enough to cover a year plus any carry-over.
+const maxBoundaryDays = 800
+
+// NextBoundary returns the first time after now at which the earliest
+// timestamp of the given time period changes, meaning that the period's query
+// has to be recomputed. The zero time is returned for [AllTime], which never
+// changes. If now is zero, then [time.Now] is used.
+func (r PeriodRules) NextBoundary(now time.Time, period TimePeriod) time.Time {
+	now = initNow(now)
+
+	switch period {
+	case AllTime:
+		return time.Time{}
+	case Last24Hours, Last7Days, Last30Days:
+		return truncateHour(now).Add(time.Hour)
+	}
+
+	// Calendar-aligned periods only change at midnight, so try each following
+	// midnight until one changes.
+	current := r.EarliestTimestamp(now, period)
+	y, m, d := now.Date()
+	for i := 1; i <= maxBoundaryDays; i++ {
+		midnight := time.Date(y, m, d+i, 0, 0, 0, 0, now.Location())
+		if !r.EarliestTimestamp(midnight, period).Equal(current) {
+			return midnight
+		}
+	}
+	return time.Time{}
+}
+
+// CalendarRange returns the calendar day, week, month or year that contains t
+// for [Daily], [Weekly], [Monthly] and [Yearly] respectively. Unlike
+// [PeriodRules.EarliestTimestamp], no carry-over is applied. False is
+// returned for the other time periods.
+func (r PeriodRules) CalendarRange(t time.Time, period TimePeriod) (TimeRange, bool) {
+	var from, to time.Time
+
+	switch period {
+	case Daily:
+		from = truncateDay(t)
+		to = from.AddDate(0, 0, 1)
+	case Weekly:
+		from = truncateWeek(t, r.WeekStart)
+		to = from.AddDate(0, 0, 7)
+	case Monthly:
+		from = truncateMonth(t)
+		to = from.AddDate(0, 1, 0)
+	case Yearly:
+		from = truncateYear(t)
+		to = from.AddDate(1, 0, 0)
+	default:
+		return TimeRange{}, false
+	}
+
+	return TimeRange{From: from, To: to}, true
+}
+
+// daysBetween returns the number of whole calendar days between the start of
+// the day of a and the day of b. It respects the timezone, so days that are
+// shortened or lengthened by daylight saving time still count as one day.
+func daysBetween(a, b time.Time) int {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	// Use UTC to count days, since it has no daylight saving time.
+	au := time.Date(ay, am, ad, 0, 0, 0, 0, time.UTC)
+	bu := time.Date(by, bm, bd, 0, 0, 0, 0, time.UTC)
+	return int(bu.Sub(au) / (24 * time.Hour))
+}
+
+// truncateHour truncates the time to the beginning of the hour.
+// It respects the timezone.
+func truncateHour(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+}
+
 // truncateDay truncates the time to the beginning of the day.
 // It respects the timezone.
 func truncateDay(t time.Time) time.Time {
@@ -47,19 +190,12 @@ func truncateDay(t time.Time) time.Time {
 	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
 }
 
-// truncateWeek truncates the time to the beginning of the week.
-func truncateWeek(t time.Time) time.Time {
+// truncateWeek truncates the time to the beginning of the week, where the week
+// starts on the given day.
+func truncateWeek(t time.Time, start time.Weekday) time.Time {
 	t = truncateDay(t)
-
-	// Sunday happens to be the first enum value in time.Weekday, so we can't
-	// even subtract it normally. Any other day of the week is fine, and
-	// subtracting the day by (weekday-1) will always give us the beginning of
-	// the week.
-	if t.Weekday() == time.Sunday {
-		return t.AddDate(0, 0, -6)
-	} else {
-		return t.AddDate(0, 0, -int(t.Weekday()-1))
-	}
+	days := (int(t.Weekday()) - int(start) + 7) % 7
+	return t.AddDate(0, 0, -days)
 }
 
 // truncateMonth truncates the time to the beginning of the month.
@@ -67,6 +203,11 @@ func truncateMonth(t time.Time) time.Time {
 	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
 }
 
+// truncateYear truncates the time to the beginning of the year.
+func truncateYear(t time.Time) time.Time {
+	return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+}
+
 func initNow(t time.Time) time.Time {
 	if t.IsZero() {
 		return time.Now().UTC()
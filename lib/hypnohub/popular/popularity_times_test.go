@@ -3,8 +3,19 @@ package popular
 import (
 	"testing"
 	"time"
+	_ "time/tzdata"
 )
 
+var newYork = mustLoadLocation("America/New_York")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
 func TestTruncateWeek(t *testing.T) {
 	tests := []struct {
 		input  time.Time
@@ -45,7 +56,7 @@ func TestTruncateWeek(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		output := truncateWeek(test.input)
+		output := truncateWeek(test.input, time.Monday)
 		if output != test.output {
 			t.Errorf("Expected %v, got %v", test.output, output)
 		}
@@ -88,11 +99,183 @@ func TestEarliestTimestampForPeriod(t *testing.T) {
 			time.Date(2024, time.January, 15, 0, 0, 0, 0, time.UTC),
 			time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
 		},
+		{
+			Monthly,
+			time.Date(2024, time.March, 31, 23, 0, 0, 0, time.UTC),
+			time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Monthly,
+			time.Date(2023, time.March, 14, 0, 0, 0, 0, time.UTC),
+			time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Yearly,
+			time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC),
+			time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Yearly,
+			time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			AllTime,
+			time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC),
+			time.Time{},
+		},
+		{
+			Last24Hours,
+			time.Date(2024, time.January, 2, 12, 34, 56, 0, time.UTC),
+			time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Last7Days,
+			time.Date(2024, time.January, 2, 12, 34, 56, 0, time.UTC),
+			time.Date(2023, time.December, 26, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Last30Days,
+			time.Date(2024, time.March, 1, 0, 30, 0, 0, time.UTC),
+			time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Last30Days,
+			time.Date(2023, time.March, 1, 0, 30, 0, 0, time.UTC),
+			time.Date(2023, time.January, 30, 0, 0, 0, 0, time.UTC),
+		},
+		// Daylight saving time started on 10 March 2024 in New York, so that
+		// day is only 23 hours long.
+		{
+			Daily,
+			time.Date(2024, time.March, 11, 1, 0, 0, 0, newYork),
+			time.Date(2024, time.March, 10, 0, 0, 0, 0, newYork),
+		},
+		{
+			Last24Hours,
+			time.Date(2024, time.March, 10, 12, 30, 0, 0, newYork),
+			time.Date(2024, time.March, 9, 11, 0, 0, 0, newYork),
+		},
+		{
+			Last7Days,
+			time.Date(2024, time.March, 12, 10, 30, 0, 0, newYork),
+			time.Date(2024, time.March, 5, 10, 0, 0, 0, newYork),
+		},
+		{
+			Weekly,
+			time.Date(2024, time.March, 10, 12, 0, 0, 0, newYork),
+			time.Date(2024, time.March, 4, 0, 0, 0, 0, newYork),
+		},
 	}
 
 	for _, test := range tests {
 		output := EarliestTimestampForPeriod(test.input, test.period)
-		if output != test.output {
+		if !output.Equal(test.output) {
+			t.Errorf("%v %v: expected %v, got %v", test.period, test.input, test.output, output)
+		}
+	}
+}
+
+func TestPeriodRules(t *testing.T) {
+	rules := PeriodRules{
+		WeekStart:          time.Sunday,
+		WeekCarryOverDays:  2,
+		MonthCarryOverDays: 0,
+		YearCarryOverDays:  0,
+		IncludeYesterday:   false,
+	}
+
+	tests := []struct {
+		period TimePeriod
+		input  time.Time
+		output time.Time
+	}{
+		{
+			Daily,
+			time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, time.January, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			DailyYesterday,
+			time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		// 2 January 2024 is a Tuesday, which is 2 days after Sunday.
+		{
+			Weekly,
+			time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC),
+			time.Date(2023, time.December, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Weekly,
+			time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC),
+			time.Date(2023, time.December, 24, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Monthly,
+			time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Yearly,
+			time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		output := rules.EarliestTimestamp(test.input, test.period)
+		if !output.Equal(test.output) {
+			t.Errorf("%v %v: expected %v, got %v", test.period, test.input, test.output, output)
+		}
+	}
+}
+
+func TestNextBoundary(t *testing.T) {
+	tests := []struct {
+		period TimePeriod
+		input  time.Time
+		output time.Time
+	}{
+		{
+			Daily,
+			time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, time.January, 3, 0, 0, 0, 0, time.UTC),
+		},
+		// 1 January 2024 is a Monday, and last week is carried over until
+		// Sunday.
+		{
+			Weekly,
+			time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, time.January, 7, 0, 0, 0, 0, time.UTC),
+		},
+		// January is carried over until 15 February.
+		{
+			Monthly,
+			time.Date(2024, time.January, 20, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, time.February, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Last24Hours,
+			time.Date(2024, time.January, 2, 12, 30, 0, 0, time.UTC),
+			time.Date(2024, time.January, 2, 13, 0, 0, 0, time.UTC),
+		},
+		// Midnight on 10 March 2024 is before New York springs forward.
+		{
+			Daily,
+			time.Date(2024, time.March, 9, 12, 0, 0, 0, newYork),
+			time.Date(2024, time.March, 10, 0, 0, 0, 0, newYork),
+		},
+		{
+			AllTime,
+			time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC),
+			time.Time{},
+		},
+	}
+
+	for _, test := range tests {
+		output := DefaultPeriodRules.NextBoundary(test.input, test.period)
+		if !output.Equal(test.output) {
 			t.Errorf("%v %v: expected %v, got %v", test.period, test.input, test.output, output)
 		}
 	}
@@ -0,0 +1,420 @@
+package popular
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+// PostsSearcherFunc is a function that implements [PostsSearcher].
+type PostsSearcherFunc func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error)
+
+// SearchPosts calls f.
+func (f PostsSearcherFunc) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	return f(ctx, query, postOffset)
+}
+
+const (
+	// DefaultCachedSearches is the default maximum number of results that a
+	// [CachingSearcher] keeps.
+	DefaultCachedSearches = 1024
+	// DefaultCachedSearchTimeout is the default maximum time that a
+	// [CachingSearcher] spends on a single search.
+	DefaultCachedSearchTimeout = time.Minute
+)
+
+// ErrCacheFull is returned by [CachingSearcher.SearchPosts] when every cached
+// result is still being searched for, so none can be evicted for a new one.
+var ErrCacheFull = errors.New("too many searches in progress, try again later")
+
+// CacheOptions are options for a [CachingSearcher].
+type CacheOptions struct {
+	// TTL is how long results are kept. If 0, then results are kept until
+	// they are evicted.
+	TTL time.Duration
+	// MaxEntries is the maximum number of results to keep, including the ones
+	// still being searched for. The oldest result is evicted when full. If 0,
+	// then [DefaultCachedSearches] is used.
+	MaxEntries int
+	// Timeout is the maximum time spent on a single search. If 0, then
+	// [DefaultCachedSearchTimeout] is used.
+	Timeout time.Duration
+	// MaxParallel, if not 0, is the maximum number of searches to make at the
+	// same time.
+	MaxParallel int
+	// KeepCancel makes searches stop once the context of the caller that
+	// started them is done, instead of carrying on for later callers. This is
+	// meant for throwaway caches whose callers all share a context, such as
+	// during a single [EstimatePostBatch], so that nothing keeps searching
+	// once they give up.
+	KeepCancel bool
+}
+
+// CachingSearcher is a PostsSearcher that caches the results of another
+// searcher by their query and offset. Concurrent searches for the same page
+// share a single search, which is not interrupted when its callers stop
+// waiting, so that the result is still cached for later calls. A search for an
+// offset within the last page of a query is served from that page, since it
+// would return the rest of the same posts. Errors are not cached. It is safe
+// to use from multiple goroutines.
+type CachingSearcher struct {
+	searcher PostsSearcher
+	opts     CacheOptions
+	sema     chan struct{} // nil if unlimited
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[cachedSearchKey]*cachedSearch
+	last    map[string]*cachedSearch // last page of each query
+}
+
+type cachedSearchKey struct {
+	query  string
+	offset int
+}
+
+type cachedSearch struct {
+	key       cachedSearchKey
+	done      chan struct{} // closed once result and err are set
+	result    *hypnohub.SearchPostsResult
+	err       error
+	fetchedAt time.Time
+}
+
+// NewCachingSearcher creates a new CachingSearcher.
+func NewCachingSearcher(searcher PostsSearcher, opts CacheOptions) *CachingSearcher {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultCachedSearches
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultCachedSearchTimeout
+	}
+	c := &CachingSearcher{
+		searcher: searcher,
+		opts:     opts,
+		now:      time.Now,
+		entries:  make(map[cachedSearchKey]*cachedSearch),
+		last:     make(map[string]*cachedSearch),
+	}
+	if opts.MaxParallel > 0 {
+		c.sema = make(chan struct{}, opts.MaxParallel)
+	}
+	return c
+}
+
+// SearchPosts implements [PostsSearcher]. If the cache is full of searches
+// that are still in progress, then [ErrCacheFull] is returned.
+func (c *CachingSearcher) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	key := cachedSearchKey{query, postOffset}
+
+	if c.opts.KeepCancel {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	if result := c.lookupLast(key); result != nil {
+		c.mu.Unlock()
+		return result, nil
+	}
+
+	entry, ok := c.entries[key]
+	if ok && c.expired(entry) {
+		c.remove(entry)
+		ok = false
+	}
+	if !ok {
+		if !c.evict() {
+			c.mu.Unlock()
+			return nil, ErrCacheFull
+		}
+		entry = &cachedSearch{key: key, done: make(chan struct{})}
+		c.entries[key] = entry
+		searchCtx := ctx
+		if !c.opts.KeepCancel {
+			// Keep the context's values, but not its cancellation, since
+			// other callers may be waiting for the same search.
+			searchCtx = context.WithoutCancel(ctx)
+		}
+		go c.search(searchCtx, entry)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.done:
+		return entry.result, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *CachingSearcher) search(ctx context.Context, entry *cachedSearch) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	if c.sema != nil {
+		select {
+		case c.sema <- struct{}{}:
+			defer func() { <-c.sema }()
+		case <-ctx.Done():
+			c.finish(entry, nil, ctx.Err())
+			return
+		}
+
+		// Both cases may have been ready, so don't search if the context
+		// was done while waiting.
+		if err := ctx.Err(); err != nil {
+			c.finish(entry, nil, err)
+			return
+		}
+	}
+
+	result, err := c.searcher.SearchPosts(ctx, entry.key.query, entry.key.offset)
+	c.finish(entry, result, err)
+}
+
+func (c *CachingSearcher) finish(entry *cachedSearch, result *hypnohub.SearchPostsResult, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.result, entry.err = result, err
+	entry.fetchedAt = c.now()
+	close(entry.done)
+
+	switch {
+	case err != nil:
+		// Don't cache errors.
+		c.remove(entry)
+	case c.entries[entry.key] == entry && isLastPage(entry):
+		c.last[entry.key.query] = entry
+	}
+}
+
+// lookupLast returns the posts from the given offset onwards if they are all
+// within the cached last page of the query, or nil otherwise. c.mu must be
+// held.
+func (c *CachingSearcher) lookupLast(key cachedSearchKey) *hypnohub.SearchPostsResult {
+	entry, ok := c.last[key.query]
+	if !ok || c.expired(entry) {
+		return nil
+	}
+
+	posts := entry.result.Posts
+	if key.offset <= entry.key.offset || key.offset >= entry.key.offset+len(posts) {
+		return nil
+	}
+
+	return &hypnohub.SearchPostsResult{
+		Posts:  posts[key.offset-entry.key.offset:],
+		Count:  entry.result.Count,
+		Offset: key.offset,
+	}
+}
+
+// isLastPage returns whether the fetched result has the last posts of its
+// query.
+func isLastPage(entry *cachedSearch) bool {
+	posts := entry.result.Posts
+	return len(posts) > 0 && entry.key.offset+len(posts) >= entry.result.Count
+}
+
+// Clear removes every cached result.
+func (c *CachingSearcher) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	clear(c.last)
+}
+
+// expired returns whether the entry has been fetched and is older than the
+// TTL. c.mu must be held.
+func (c *CachingSearcher) expired(entry *cachedSearch) bool {
+	select {
+	case <-entry.done:
+		return c.opts.TTL > 0 && c.now().Sub(entry.fetchedAt) >= c.opts.TTL
+	default:
+		return false // still searching
+	}
+}
+
+// remove removes the entry if it is still cached. c.mu must be held.
+func (c *CachingSearcher) remove(entry *cachedSearch) {
+	if c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+	if c.last[entry.key.query] == entry {
+		delete(c.last, entry.key.query)
+	}
+}
+
+// evict removes the oldest fetched result if the cache is full. Searches in
+// progress count towards the limit but cannot be evicted, so false is
+// returned if there is no room for another result. c.mu must be held.
+func (c *CachingSearcher) evict() bool {
+	if len(c.entries) < c.opts.MaxEntries {
+		return true
+	}
+
+	var oldest *cachedSearch
+	for _, entry := range c.entries {
+		select {
+		case <-entry.done:
+		default:
+			continue // still searching
+		}
+		if oldest == nil || entry.fetchedAt.Before(oldest.fetchedAt) {
+			oldest = entry
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+	c.remove(oldest)
+	return true
+}
+
+// CountingSearcher is a PostsSearcher that counts the searches made using
+// another searcher. It is safe to use from multiple goroutines.
+type CountingSearcher struct {
+	searcher PostsSearcher
+	count    atomic.Int64
+	errors   atomic.Int64
+}
+
+// NewCountingSearcher creates a new CountingSearcher.
+func NewCountingSearcher(searcher PostsSearcher) *CountingSearcher {
+	return &CountingSearcher{searcher: searcher}
+}
+
+// SearchPosts implements [PostsSearcher].
+func (c *CountingSearcher) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	c.count.Add(1)
+	result, err := c.searcher.SearchPosts(ctx, query, postOffset)
+	if err != nil {
+		c.errors.Add(1)
+	}
+	return result, err
+}
+
+// Count returns the number of searches made so far.
+func (c *CountingSearcher) Count() int {
+	return int(c.count.Load())
+}
+
+// Errors returns the number of searches that failed so far.
+func (c *CountingSearcher) Errors() int {
+	return int(c.errors.Load())
+}
+
+// Reset resets the counts to 0.
+func (c *CountingSearcher) Reset() {
+	c.count.Store(0)
+	c.errors.Store(0)
+}
+
+// LoggingSearcher returns a PostsSearcher that logs every search made using
+// the given searcher. Searches are logged at the debug level, and failed
+// searches at the warning level.
+func LoggingSearcher(searcher PostsSearcher, logger *slog.Logger) PostsSearcher {
+	return searchLogger{searcher, logger}
+}
+
+type searchLogger struct {
+	PostsSearcher
+	logger *slog.Logger
+}
+
+func (l searchLogger) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	start := time.Now()
+	result, err := l.PostsSearcher.SearchPosts(ctx, query, postOffset)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		l.logger.WarnContext(ctx,
+			"cannot search posts",
+			"query", query,
+			"offset", postOffset,
+			"elapsed", elapsed,
+			"err", err)
+		return result, err
+	}
+
+	l.logger.DebugContext(ctx,
+		"searched posts",
+		"query", query,
+		"offset", postOffset,
+		"posts", len(result.Posts),
+		"count", result.Count,
+		"elapsed", elapsed)
+	return result, err
+}
+
+// ErrInjectedFault is the default error returned by a [FaultySearcher].
+var ErrInjectedFault = errors.New("injected search fault")
+
+// FaultOptions are options for a [FaultySearcher].
+type FaultOptions struct {
+	// Err is the error returned by failed searches. If nil, then
+	// [ErrInjectedFault] is used.
+	Err error
+	// FailEvery makes every nth search fail. If 0, then searches only fail
+	// if Match says so.
+	FailEvery int
+	// Match, if not nil, makes every search that it returns true for fail.
+	Match func(query string, postOffset int) bool
+	// Delay is how long every search waits before it is made or fails. The
+	// wait stops early if the context is done.
+	Delay time.Duration
+}
+
+// FaultySearcher is a PostsSearcher that makes the searches made using
+// another searcher fail or slow down, which helps with testing how callers
+// cope with an unreliable upstream. It is safe to use from multiple
+// goroutines.
+type FaultySearcher struct {
+	searcher PostsSearcher
+	opts     FaultOptions
+	count    atomic.Int64
+}
+
+// NewFaultySearcher creates a new FaultySearcher.
+func NewFaultySearcher(searcher PostsSearcher, opts FaultOptions) *FaultySearcher {
+	if opts.Err == nil {
+		opts.Err = ErrInjectedFault
+	}
+	return &FaultySearcher{
+		searcher: searcher,
+		opts:     opts,
+	}
+}
+
+// SearchPosts implements [PostsSearcher].
+func (f *FaultySearcher) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	n := f.count.Add(1)
+
+	if f.opts.Delay > 0 {
+		timer := time.NewTimer(f.opts.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if f.opts.FailEvery > 0 && n%int64(f.opts.FailEvery) == 0 {
+		return nil, f.opts.Err
+	}
+	if f.opts.Match != nil && f.opts.Match(query, postOffset) {
+		return nil, f.opts.Err
+	}
+
+	return f.searcher.SearchPosts(ctx, query, postOffset)
+}
@@ -0,0 +1,247 @@
+package popular
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+var searchersTestPosts = []mockPost{
+	{2000, testDate("01-02-2020 21:00")},
+	{1999, testDate("01-02-2020 02:00")},
+	{1998, testDate("31-01-2020 23:00")},
+	{1997, testDate("30-01-2020 22:00")},
+	{1996, testDate("29-01-2020 21:00")},
+	{1995, testDate("28-01-2020 21:00")},
+}
+
+func TestCachingSearcher(t *testing.T) {
+	ctx := context.Background()
+	now := testDate("01-02-2020 21:00")
+
+	counter := NewCountingSearcher(newPostsSearcher(searchersTestPosts))
+	faulty := NewFaultySearcher(counter, FaultOptions{
+		Match: func(query string, postOffset int) bool { return postOffset == 1 },
+	})
+	cache := NewCachingSearcher(faulty, CacheOptions{TTL: time.Hour, MaxEntries: 2})
+	cache.now = func() time.Time { return now }
+
+	search := func(postOffset int) *hypnohub.SearchPostsResult {
+		t.Helper()
+		result, err := cache.SearchPosts(ctx, "", postOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	for i := 0; i < 3; i++ {
+		result := search(0)
+		if len(result.Posts) != 3 || result.Posts[0].ID != 2000 {
+			t.Fatalf("unexpected result %+v", result)
+		}
+	}
+	if n := counter.Count(); n != 1 {
+		t.Errorf("expected 1 search for the same page, got %d", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.SearchPosts(ctx, "", 1); !errors.Is(err, ErrInjectedFault) {
+			t.Fatalf("expected injected fault, got %v", err)
+		}
+	}
+	if n := counter.Count(); n != 1 {
+		t.Errorf("expected faults to not reach the searcher, got %d searches", n)
+	}
+	if n := faulty.count.Load(); n != 3 {
+		t.Errorf("expected errors to not be cached, got %d searches", n)
+	}
+
+	now = now.Add(time.Minute)
+	search(3)
+	if n := counter.Count(); n != 2 {
+		t.Errorf("expected 2 searches for different pages, got %d", n)
+	}
+
+	// The page at offset 3 is the last one, so it has every later post.
+	if result := search(4); len(result.Posts) != 2 || result.Posts[0].ID != 1996 || result.Offset != 4 {
+		t.Errorf("unexpected result within the last page %+v", result)
+	}
+	if n := counter.Count(); n != 2 {
+		t.Errorf("expected offset within the last page to not search, got %d searches", n)
+	}
+
+	now = now.Add(time.Hour - time.Minute)
+	search(0)
+	if n := counter.Count(); n != 3 {
+		t.Errorf("expected expired page to be searched again, got %d searches", n)
+	}
+
+	// The cache only keeps 2 pages, so the oldest one, which is the last
+	// page, is evicted.
+	now = now.Add(time.Minute)
+	search(2)
+	search(4)
+	if n := counter.Count(); n != 5 {
+		t.Errorf("expected evicted last page to be searched again, got %d searches", n)
+	}
+
+	cache.Clear()
+	search(2)
+	if n := counter.Count(); n != 6 {
+		t.Errorf("expected cleared page to be searched again, got %d searches", n)
+	}
+}
+
+func TestCachingSearcherDetached(t *testing.T) {
+	posts := newPostsSearcher(searchersTestPosts)
+
+	// Searches hang until the test releases them or their context is done.
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	counter := NewCountingSearcher(PostsSearcherFunc(func(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return posts.SearchPosts(ctx, query, postOffset)
+	}))
+	cache := NewCachingSearcher(counter, CacheOptions{MaxEntries: 1})
+
+	// The first caller gives up, but the search carries on for the next one.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cache.SearchPosts(ctx, "", 0)
+		errc <- err
+	}()
+
+	<-started
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the caller to be cancelled, got %v", err)
+	}
+
+	// The only entry is still being searched for, so it cannot be evicted.
+	if _, err := cache.SearchPosts(context.Background(), "", 3); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("expected ErrCacheFull, got %v", err)
+	}
+
+	close(release)
+
+	result, err := cache.SearchPosts(context.Background(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Posts) != 3 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if counter.Count() != 1 || counter.Errors() != 0 {
+		t.Errorf("expected a single uncancelled search, got %d searches and %d errors", counter.Count(), counter.Errors())
+	}
+}
+
+func TestCountingSearcher(t *testing.T) {
+	ctx := context.Background()
+
+	counter := NewCountingSearcher(NewFaultySearcher(newPostsSearcher(searchersTestPosts), FaultOptions{
+		FailEvery: 2,
+	}))
+	for i := 0; i < 5; i++ {
+		counter.SearchPosts(ctx, "", 0)
+	}
+	if n := counter.Count(); n != 5 {
+		t.Errorf("expected 5 searches, got %d", n)
+	}
+	if n := counter.Errors(); n != 2 {
+		t.Errorf("expected 2 errors, got %d", n)
+	}
+
+	counter.Reset()
+	if counter.Count() != 0 || counter.Errors() != 0 {
+		t.Errorf("expected counts to be reset, got %d and %d", counter.Count(), counter.Errors())
+	}
+}
+
+func TestFaultySearcher(t *testing.T) {
+	errDown := errors.New("hypnohub is down")
+
+	t.Run("fail every", func(t *testing.T) {
+		faulty := NewFaultySearcher(newPostsSearcher(searchersTestPosts), FaultOptions{
+			Err:       errDown,
+			FailEvery: 3,
+		})
+		for i := 1; i <= 6; i++ {
+			_, err := faulty.SearchPosts(context.Background(), "", 0)
+			if fail := i%3 == 0; fail != errors.Is(err, errDown) {
+				t.Errorf("search %d: unexpected error %v", i, err)
+			}
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		faulty := NewFaultySearcher(newPostsSearcher(searchersTestPosts), FaultOptions{
+			Delay: time.Hour,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		if _, err := faulty.SearchPosts(ctx, "", 0); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	})
+
+	t.Run("estimate", func(t *testing.T) {
+		faulty := NewFaultySearcher(newPostsSearcher(searchersTestPosts), FaultOptions{
+			Err:   errDown,
+			Match: func(query string, postOffset int) bool { return postOffset > 0 },
+		})
+
+		_, err := EstimatePostHistory(context.Background(), faulty, EstimatePostOptions{
+			Now:    testDate("01-02-2020 21:00"),
+			Period: Weekly,
+		})
+		if !errors.Is(err, errDown) {
+			t.Errorf("expected estimate to fail with the injected error, got %v", err)
+		}
+	})
+}
+
+func TestLoggingSearcher(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	searcher := LoggingSearcher(NewFaultySearcher(newPostsSearcher(searchersTestPosts), FaultOptions{
+		Match: func(query string, postOffset int) bool { return postOffset == 3 },
+	}), logger)
+
+	searcher.SearchPosts(context.Background(), "id:<=1999", 0)
+	searcher.SearchPosts(context.Background(), "", 3)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %q", buf.String())
+	}
+	for _, want := range []string{"level=DEBUG", `query="id:<=1999"`, "offset=0", "posts=3", "count=5"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("expected %q in %q", want, lines[0])
+		}
+	}
+	for _, want := range []string{"level=WARN", "offset=3", "err=\"injected search fault\""} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("expected %q in %q", want, lines[1])
+		}
+	}
+}
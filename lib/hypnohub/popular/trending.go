@@ -0,0 +1,171 @@
+package popular
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+const (
+	// DefaultTrendingWindow is the default window of recent posts that a
+	// [TrendingTracker] ranks.
+	DefaultTrendingWindow = 7 * 24 * time.Hour
+	// DefaultTrendingMinAge is the default minimum age that a
+	// [TrendingTracker] assumes for each post, so that posts that were just
+	// uploaded don't rank highly from a single vote.
+	DefaultTrendingMinAge = 3 * time.Hour
+	// DefaultTrendingMaxPages is the default maximum number of pages that a
+	// [TrendingTracker] fetches per snapshot.
+	DefaultTrendingMaxPages = 20
+	// DefaultTrendingInterval is the default interval at which
+	// [TrendingTracker.Run] takes snapshots.
+	DefaultTrendingInterval = 15 * time.Minute
+)
+
+// TrendingOptions are options for a [TrendingTracker].
+type TrendingOptions struct {
+	// Window is how recent a post must be to be ranked. If 0, then
+	// [DefaultTrendingWindow] is used.
+	Window time.Duration
+	// MinAge is the minimum age assumed for each post when computing its
+	// score velocity. If 0, then [DefaultTrendingMinAge] is used.
+	MinAge time.Duration
+	// MaxPages is the maximum number of pages of posts fetched per snapshot.
+	// If 0, then [DefaultTrendingMaxPages] is used.
+	MaxPages int
+	// Interval is the interval at which [TrendingTracker.Run] takes
+	// snapshots. If 0, then [DefaultTrendingInterval] is used.
+	Interval time.Duration
+}
+
+// TrendingPost is a post ranked by a [TrendingTracker].
+type TrendingPost struct {
+	hypnohub.Post
+	// ScorePerHour is the score that the post gained per hour since it was
+	// created.
+	ScorePerHour float64
+}
+
+// TrendingTracker ranks recent posts by how quickly they gain score, which
+// surfaces newly uploaded hits that sorting by score would bury under older
+// posts. It periodically snapshots the scores of recent posts. It is safe to
+// use from multiple goroutines.
+type TrendingTracker struct {
+	searcher PostsSearcher
+	opts     TrendingOptions
+	now      func() time.Time
+
+	mu         sync.Mutex
+	posts      []TrendingPost // sorted by ScorePerHour, descending
+	snapshotAt time.Time
+}
+
+// NewTrendingTracker creates a new TrendingTracker. No posts are ranked until
+// the first snapshot is taken.
+func NewTrendingTracker(searcher PostsSearcher, opts TrendingOptions) *TrendingTracker {
+	if opts.Window == 0 {
+		opts.Window = DefaultTrendingWindow
+	}
+	if opts.MinAge == 0 {
+		opts.MinAge = DefaultTrendingMinAge
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = DefaultTrendingMaxPages
+	}
+	if opts.Interval == 0 {
+		opts.Interval = DefaultTrendingInterval
+	}
+	return &TrendingTracker{
+		searcher: searcher,
+		opts:     opts,
+		now:      time.Now,
+	}
+}
+
+// Run takes a snapshot every [TrendingOptions.Interval] until the context is
+// done. Errors are logged.
+func (t *TrendingTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.Snapshot(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn(
+				"cannot snapshot trending posts",
+				"err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Snapshot fetches the scores of the posts created within the window and
+// ranks them again.
+func (t *TrendingTracker) Snapshot(ctx context.Context) error {
+	now := t.now()
+	since := now.Add(-t.opts.Window)
+
+	var posts []TrendingPost
+	offset := 0
+
+pages:
+	for page := 0; page < t.opts.MaxPages; page++ {
+		result, err := t.searcher.SearchPosts(ctx, "", offset)
+		if err != nil {
+			return fmt.Errorf("searching posts at offset %d: %w", offset, err)
+		}
+		if len(result.Posts) == 0 {
+			break
+		}
+
+		for _, post := range result.Posts {
+			createdAt := post.CreatedAt.Time()
+			if createdAt.Before(since) {
+				break pages
+			}
+
+			age := max(now.Sub(createdAt), t.opts.MinAge)
+			posts = append(posts, TrendingPost{
+				Post:         post,
+				ScorePerHour: float64(post.Score) / age.Hours(),
+			})
+		}
+
+		offset += len(result.Posts)
+	}
+
+	slices.SortStableFunc(posts, func(a, b TrendingPost) int {
+		return cmp.Compare(b.ScorePerHour, a.ScorePerHour)
+	})
+
+	t.mu.Lock()
+	t.posts = posts
+	t.snapshotAt = now
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Trending returns up to limit posts that gained score the fastest, along
+// with the time of the snapshot that they were ranked at. If limit is 0 or
+// less, then all ranked posts are returned.
+func (t *TrendingTracker) Trending(limit int) ([]TrendingPost, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	posts := t.posts
+	if limit > 0 && len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return slices.Clone(posts), t.snapshotAt
+}
@@ -0,0 +1,66 @@
+package popular
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+func TestTrendingTracker(t *testing.T) {
+	now := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	searcher := scoredPostsSearcher{
+		{ID: 5, Score: 1, CreatedAt: hypnohub.Date(now.Add(-10 * time.Minute))},
+		{ID: 4, Score: 30, CreatedAt: hypnohub.Date(now.Add(-6 * time.Hour))},
+		{ID: 3, Score: 48, CreatedAt: hypnohub.Date(now.Add(-2 * 24 * time.Hour))},
+		{ID: 2, Score: 200, CreatedAt: hypnohub.Date(now.Add(-5 * 24 * time.Hour))},
+		{ID: 1, Score: 900, CreatedAt: hypnohub.Date(now.Add(-30 * 24 * time.Hour))},
+	}
+
+	tracker := NewTrendingTracker(searcher, TrendingOptions{})
+	tracker.now = func() time.Time { return now }
+
+	if err := tracker.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	posts, at := tracker.Trending(3)
+	if !at.Equal(now) {
+		t.Errorf("expected snapshot at %v, got %v", now, at)
+	}
+
+	// Post 1 is outside the window. Post 5 is younger than the minimum age,
+	// so its single vote is spread over 3 hours.
+	expect := []hypnohub.PostID{4, 2, 3}
+	if len(posts) != len(expect) {
+		t.Fatalf("expected %d posts, got %d", len(expect), len(posts))
+	}
+	for i, id := range expect {
+		if posts[i].ID != id {
+			t.Errorf("post %d: expected %d, got %d (%.2f/h)", i, id, posts[i].ID, posts[i].ScorePerHour)
+		}
+	}
+	if posts[0].ScorePerHour != 5 {
+		t.Errorf("expected post 4 to gain 5 per hour, got %v", posts[0].ScorePerHour)
+	}
+}
+
+// scoredPostsSearcher is a PostsSearcher over posts sorted by descending ID.
+// It only supports the empty query and returns 2 posts per page.
+type scoredPostsSearcher []hypnohub.Post
+
+func (s scoredPostsSearcher) SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	if query != "" {
+		panic("unsupported query " + query)
+	}
+
+	posts := s[min(postOffset, len(s)):]
+	posts = posts[:min(2, len(posts))]
+
+	return &hypnohub.SearchPostsResult{
+		Posts:  posts,
+		Count:  len(s),
+		Offset: postOffset,
+	}, nil
+}
@@ -0,0 +1,162 @@
+package query
+
+import (
+	"slices"
+	"strings"
+)
+
+// term is a single tag within a clause. It may be negated.
+type term struct {
+	tag     string
+	negated bool
+}
+
+func parseTerm(s string) term {
+	if tag, ok := strings.CutPrefix(s, "-"); ok {
+		return term{tag: tag, negated: true}
+	}
+	return term{tag: s}
+}
+
+func (t term) negate() term {
+	return term{tag: t.tag, negated: !t.negated}
+}
+
+func (t term) String() string {
+	if t.negated {
+		return "-" + t.tag
+	}
+	return t.tag
+}
+
+// clause is a disjunction of terms. Each element of a Query is a clause, so
+// a Query is always in conjunctive normal form. This is the only form that
+// Hypnohub can express: it has no way of negating or nesting OR groups.
+type clause []term
+
+// parseClause parses a single Query element into a clause. Tags are assumed
+// to be escaped, so they never contain whitespace or braces.
+func parseClause(s string) clause {
+	inner, ok := strings.CutPrefix(s, "{")
+	if !ok {
+		return clause{parseTerm(s)}
+	}
+	inner = strings.TrimSuffix(inner, "}")
+
+	var c clause
+	for _, field := range strings.Fields(inner) {
+		if field != "~" {
+			c = append(c, parseTerm(field))
+		}
+	}
+	return c
+}
+
+func (c clause) String() string {
+	if len(c) == 1 {
+		return c[0].String()
+	}
+	terms := make([]string, len(c))
+	for i, t := range c {
+		terms[i] = t.String()
+	}
+	return "{" + strings.Join(terms, " ~ ") + "}"
+}
+
+// isTautology returns true if the clause contains both a term and its
+// negation, meaning that it matches everything.
+func (c clause) isTautology() bool {
+	for _, t := range c {
+		if slices.Contains(c, t.negate()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubsetOf returns true if all terms in c are also in other.
+func (c clause) isSubsetOf(other clause) bool {
+	for _, t := range c {
+		if !slices.Contains(other, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// dedup returns the clause with duplicate terms removed. The order of the
+// first occurrence of each term is preserved.
+func (c clause) dedup() clause {
+	out := make(clause, 0, len(c))
+	for _, t := range c {
+		if !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (q Query) clauses() []clause {
+	clauses := make([]clause, 0, len(q))
+	for _, s := range q {
+		if s != "" {
+			clauses = append(clauses, parseClause(s))
+		}
+	}
+	return clauses
+}
+
+func fromClauses(clauses []clause) Query {
+	if len(clauses) == 0 {
+		return nil
+	}
+	q := make(Query, 0, len(clauses))
+	for _, c := range clauses {
+		if len(c) > 0 {
+			q = append(q, c.String())
+		}
+	}
+	return q
+}
+
+// mapTerms returns a copy of the query with f applied to every term.
+func mapTerms(q Query, f func(term) term) Query {
+	clauses := q.clauses()
+	for i, c := range clauses {
+		c = slices.Clone(c)
+		for j, t := range c {
+			c[j] = f(t)
+		}
+		clauses[i] = c
+	}
+	return fromClauses(clauses)
+}
+
+// distribute returns the disjunction of the given queries in conjunctive
+// normal form. It does so by distributing OR over AND, so (a AND b) OR c
+// becomes (a OR c) AND (b OR c).
+func distribute(qs []Query) []clause {
+	var result []clause
+	for _, q := range qs {
+		clauses := q.clauses()
+		if len(clauses) == 0 {
+			continue
+		}
+		if result == nil {
+			result = clauses
+			continue
+		}
+
+		product := make([]clause, 0, len(result)*len(clauses))
+		for _, c1 := range result {
+			for _, c2 := range clauses {
+				c := make(clause, 0, len(c1)+len(c2))
+				c = append(c, c1...)
+				c = append(c, c2...)
+				product = append(product, c)
+			}
+		}
+		result = product
+	}
+	return result
+}
@@ -0,0 +1,183 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+)
+
+// Parse parses a query string as written on Hypnohub, such as
+// "skirt -rating:explicit {a ~ b}". Unlike [Tag], the tags are not escaped,
+// so all operators are kept. An error is returned if an OR group is
+// malformed, since Hypnohub would silently misinterpret it.
+func Parse(s string) (Query, error) {
+	var clauses []clause
+	var group clause
+	var inGroup bool
+
+	for _, field := range strings.Fields(s) {
+		if strings.HasPrefix(field, "-{") {
+			return nil, fmt.Errorf("cannot negate OR group at %q", field)
+		}
+
+		opening := strings.HasPrefix(field, "{")
+		if opening {
+			if inGroup {
+				return nil, fmt.Errorf("cannot nest OR groups at %q", field)
+			}
+			inGroup = true
+			group = nil
+			field = field[1:]
+		}
+
+		closing := inGroup && strings.HasSuffix(field, "}")
+		if closing {
+			field = field[:len(field)-1]
+		}
+
+		if strings.ContainsAny(field, "{}") {
+			return nil, fmt.Errorf("unexpected brace in %q", field)
+		}
+
+		switch {
+		case !inGroup:
+			if field == "~" {
+				return nil, fmt.Errorf("unexpected ~ outside of OR group")
+			}
+			clauses = append(clauses, clause{parseTerm(field)})
+		case field != "" && field != "~":
+			group = append(group, parseTerm(field))
+		}
+
+		if closing {
+			if len(group) == 0 {
+				return nil, fmt.Errorf("empty OR group")
+			}
+			clauses = append(clauses, group)
+			inGroup = false
+		}
+	}
+
+	if inGroup {
+		return nil, fmt.Errorf("unclosed OR group")
+	}
+
+	return fromClauses(clauses), nil
+}
+
+// MustParse is like [Parse], but panics on error.
+func MustParse(s string) Query {
+	q, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// MarshalText implements encoding.TextMarshaler. It encodes the query in
+// the same form as [Query.String].
+func (q Query) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It decodes the query
+// using [Parse].
+func (q *Query) UnmarshalText(text []byte) error {
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*q = v
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. The query is encoded as a list of
+// OR groups that are joined with AND, where each OR group is a list of tags.
+// For example, "skirt {a ~ -b}" is encoded as [["skirt"],["a","-b"]].
+func (q Query) MarshalJSON() ([]byte, error) {
+	clauses := q.clauses()
+	v := make([][]string, len(clauses))
+	for i, c := range clauses {
+		v[i] = make([]string, len(c))
+		for j, t := range c {
+			v[i][j] = t.String()
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. On top of the form produced by
+// [Query.MarshalJSON], it also accepts a query string, such as
+// "skirt {a ~ -b}", and a list of query strings, such as
+// ["skirt", "{a ~ -b}"].
+func (q *Query) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		return q.UnmarshalText([]byte(str))
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(b, &elems); err != nil {
+		return fmt.Errorf("query must be a string or an array: %w", err)
+	}
+
+	var clauses []clause
+	for _, elem := range elems {
+		var str string
+		if err := json.Unmarshal(elem, &str); err == nil {
+			v, err := Parse(str)
+			if err != nil {
+				return err
+			}
+			clauses = append(clauses, v.clauses()...)
+			continue
+		}
+
+		var tags []string
+		if err := json.Unmarshal(elem, &tags); err != nil {
+			return fmt.Errorf("query element must be a string or an array of strings: %w", err)
+		}
+
+		c := make(clause, 0, len(tags))
+		for _, tag := range tags {
+			if tag == "" || tag == "~" || strings.ContainsAny(tag, "{} \t\n") {
+				return fmt.Errorf("invalid tag %q in OR group", tag)
+			}
+			c = append(c, parseTerm(tag))
+		}
+		if len(c) > 0 {
+			clauses = append(clauses, c)
+		}
+	}
+
+	*q = fromClauses(clauses)
+	return nil
+}
+
+// WebURL returns the URL of the Hypnohub web page that lists the posts
+// matching the query.
+func (q Query) WebURL() string {
+	v := url.Values{
+		"page": {"post"},
+		"s":    {"list"},
+		"tags": {q.String()},
+	}
+	return hypnohub.BaseURL + "?" + v.Encode()
+}
+
+// ParseWebURL parses the query from the URL of a Hypnohub web page that lists
+// posts, such as one returned by [Query.WebURL].
+func ParseWebURL(rawURL string) (Query, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	v := u.Query()
+	if v.Get("page") != "post" || v.Get("s") != "list" {
+		return nil, fmt.Errorf("not a Hypnohub post list URL")
+	}
+	return Parse(v.Get("tags"))
+}
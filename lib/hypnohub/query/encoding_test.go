@@ -0,0 +1,107 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+		err    bool
+	}{
+		{input: "skirt -rating:explicit", expect: "skirt -rating:explicit"},
+		{input: "  skirt   {a ~ -b}  ", expect: "skirt {a ~ -b}"},
+		{input: "{ a ~ b }", expect: "{a ~ b}"},
+		{input: "{a}", expect: "a"},
+		{input: "hypno* sort:score:desc", expect: "hypno* sort:score:desc"},
+		{input: "", expect: ""},
+		{input: "{a ~ b", err: true},
+		{input: "a ~ b", err: true},
+		{input: "-{a ~ b}", err: true},
+		{input: "{a ~ {b ~ c}}", err: true},
+		{input: "{}", err: true},
+		{input: "a}", err: true},
+	}
+
+	for _, test := range tests {
+		q, err := Parse(test.input)
+		if test.err {
+			if err == nil {
+				t.Errorf("Parse(%q): expected error, got %q", test.input, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): unexpected error: %v", test.input, err)
+			continue
+		}
+		if q.String() != test.expect {
+			t.Errorf("Parse(%q): expected %q, got %q", test.input, test.expect, q)
+		}
+	}
+}
+
+func TestQueryJSON(t *testing.T) {
+	q := And(Tag("skirt"), Or(Tag("a"), Not(Tag("b"))))
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `[["skirt"],["a","-b"]]` {
+		t.Errorf("unexpected JSON %s", b)
+	}
+
+	inputs := []string{
+		string(b),
+		`"skirt {a ~ -b}"`,
+		`["skirt", "{a ~ -b}"]`,
+		`["skirt", ["a", "-b"]]`,
+	}
+	for _, input := range inputs {
+		var q Query
+		if err := json.Unmarshal([]byte(input), &q); err != nil {
+			t.Errorf("%s: unexpected error: %v", input, err)
+			continue
+		}
+		if q.String() != "skirt {a ~ -b}" {
+			t.Errorf("%s: unexpected query %q", input, q)
+		}
+	}
+
+	invalid := []string{
+		`42`,
+		`"{a ~ b"`,
+		`[["a b"]]`,
+		`[["{a"]]`,
+	}
+	for _, input := range invalid {
+		var q Query
+		if err := json.Unmarshal([]byte(input), &q); err == nil {
+			t.Errorf("%s: expected error, got %q", input, q)
+		}
+	}
+}
+
+func TestWebURL(t *testing.T) {
+	q := And(Tag("skirt"), Not(Tag("dress")))
+
+	url := q.WebURL()
+	if url != "https://hypnohub.net/index.php?page=post&s=list&tags=skirt+-dress" {
+		t.Errorf("unexpected URL %q", url)
+	}
+
+	parsed, err := ParseWebURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != q.String() {
+		t.Errorf("expected %q, got %q", q, parsed)
+	}
+
+	if _, err := ParseWebURL("https://hypnohub.net/index.php?page=dapi&s=post&q=index"); err == nil {
+		t.Error("expected error for API URL")
+	}
+}
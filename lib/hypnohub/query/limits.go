@@ -0,0 +1,149 @@
+package query
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Cost describes how expensive a query is for Hypnohub to run.
+type Cost struct {
+	// Tags is the total number of tags in the query, including metatags and
+	// tags within OR groups.
+	Tags int
+	// Wildcards is the number of tags that contain a wildcard.
+	Wildcards int
+	// OrTerms is the total number of tags within OR groups.
+	OrTerms int
+}
+
+// Cost returns the cost of the query.
+func (q Query) Cost() Cost {
+	var cost Cost
+	for _, c := range q.clauses() {
+		cost.Tags += len(c)
+		if len(c) > 1 {
+			cost.OrTerms += len(c)
+		}
+		for _, t := range c {
+			if strings.Contains(t.tag, "*") {
+				cost.Wildcards++
+			}
+		}
+	}
+	return cost
+}
+
+// Limits are the limits that a backend imposes on queries. A zero limit means
+// that there is no limit.
+type Limits struct {
+	MaxTags      int
+	MaxWildcards int
+	MaxOrTerms   int
+}
+
+// DefaultLimits are conservative limits for Hypnohub. Hypnohub does not
+// document its limits, so these are chosen to stay well within what it
+// accepts without slowing down.
+var DefaultLimits = Limits{
+	MaxTags:      20,
+	MaxWildcards: 2,
+	MaxOrTerms:   12,
+}
+
+// exceeded returns a description of each limit that the cost exceeds.
+func (l Limits) exceeded(cost Cost) []string {
+	var exceeded []string
+	check := func(name string, n, max int) {
+		if max > 0 && n > max {
+			exceeded = append(exceeded, fmt.Sprintf("%d %s (limit %d)", n, name, max))
+		}
+	}
+	check("tags", cost.Tags, l.MaxTags)
+	check("wildcards", cost.Wildcards, l.MaxWildcards)
+	check("OR terms", cost.OrTerms, l.MaxOrTerms)
+	return exceeded
+}
+
+// LimitError is returned by [Query.CheckLimits] when a query exceeds the
+// backend's limits.
+type LimitError struct {
+	Query  Query
+	Cost   Cost
+	Limits Limits
+	// Split is the query split into multiple queries that are each within the
+	// limits. Running each of them and merging their results gives the same
+	// results as the original query. It is nil if the query cannot be split.
+	Split []Query
+}
+
+// Error implements error.
+func (e *LimitError) Error() string {
+	msg := "query has " + strings.Join(e.Limits.exceeded(e.Cost), ", ")
+	if e.Split != nil {
+		msg += fmt.Sprintf("; split it into %d queries and merge the results", len(e.Split))
+	}
+	return msg
+}
+
+// CheckLimits returns a [*LimitError] if the query exceeds the given limits.
+func (q Query) CheckLimits(limits Limits) error {
+	cost := q.Cost()
+	if len(limits.exceeded(cost)) == 0 {
+		return nil
+	}
+
+	err := &LimitError{
+		Query:  q,
+		Cost:   cost,
+		Limits: limits,
+	}
+	if split := q.Split(limits); len(split) > 1 && allWithinLimits(split, limits) {
+		err.Split = split
+	}
+	return err
+}
+
+// Split splits the query into multiple queries that are each within the given
+// limits by dividing its largest OR group. The union of the results of the
+// returned queries is the same as the results of the original query.
+//
+// If the query is already within the limits, then it is returned as-is. If
+// the query cannot be split any further, then some of the returned queries
+// may still exceed the limits.
+func (q Query) Split(limits Limits) []Query {
+	if len(limits.exceeded(q.Cost())) == 0 {
+		return []Query{q}
+	}
+
+	clauses := q.clauses()
+	largest := -1
+	for i, c := range clauses {
+		if len(c) > 1 && (largest == -1 || len(c) > len(clauses[largest])) {
+			largest = i
+		}
+	}
+	if largest == -1 {
+		return []Query{q}
+	}
+
+	group := clauses[largest]
+	half := len(group) / 2
+
+	split := make([]Query, 0, 2)
+	for _, part := range []clause{group[:half], group[half:]} {
+		clauses := slices.Clone(clauses)
+		clauses[largest] = part
+		split = append(split, fromClauses(clauses).Split(limits)...)
+	}
+	return split
+}
+
+func allWithinLimits(qs []Query, limits Limits) bool {
+	for _, q := range qs {
+		if len(limits.exceeded(q.Cost())) > 0 {
+			return false
+		}
+	}
+	return true
+}
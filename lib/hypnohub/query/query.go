@@ -1,6 +1,8 @@
 package query
 
 import (
+	"errors"
+	"fmt"
 	"slices"
 	"strconv"
 	"strings"
@@ -12,14 +14,120 @@ import (
 // It is a slice of strings, where each string is a tag.
 type Query []string
 
-// NewQuery creates a new Query with the given tags.
+// NewQuery creates a new Query with the given tags, each added using [Tag].
 func NewQuery(tags ...string) Query {
-	return Query(tags)
+	q := make(Query, 0, len(tags))
+	for _, tag := range tags {
+		q = append(q, Tag(tag)...)
+	}
+	return q
+}
+
+// NewEscapedQuery is like [NewQuery], but returns an error if a tag cannot be
+// escaped. See [EscapedTag].
+func NewEscapedQuery(tags ...string) (Query, error) {
+	q := make(Query, 0, len(tags))
+	for _, tag := range tags {
+		t, err := EscapedTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, t...)
+	}
+	return q, nil
 }
 
-// Tag returns a Query with the given tag.
+// Tag returns a Query with the given tag. Whitespace in the tag is replaced
+// with underscores. If the tag is empty, then an empty Query is returned.
+//
+// Tags that cannot be escaped using [EscapeTag] are used as they are, so Tag
+// is meant for tags that are known ahead of time. Tags supplied by users
+// should use [EscapedTag] instead.
 func Tag(s string) Query {
-	return Query{s}
+	return literalQuery("", s, "")
+}
+
+// EscapedTag is like [Tag], but returns an error wrapping [ErrInvalidTag] if
+// the tag cannot be escaped using [EscapeTag], so that the tag is always
+// matched literally.
+func EscapedTag(s string) (Query, error) {
+	return escapedQuery("", s, "")
+}
+
+// ErrInvalidTag is returned by [EscapeTag] for tags that cannot be escaped.
+var ErrInvalidTag = errors.New("invalid tag")
+
+// metatags are the names of Hypnohub's metatags, which are tags of the form
+// name:value that filter or sort posts instead of matching a tag.
+var metatags = []string{
+	"date",
+	"fav",
+	"height",
+	"id",
+	"md5",
+	"parent",
+	"pool",
+	"rating",
+	"score",
+	"sort",
+	"source",
+	"status",
+	"sub",
+	"tagcount",
+	"user",
+	"width",
+}
+
+// EscapeTag escapes the given tag so that it is always interpreted as a
+// single literal tag by Hypnohub. Whitespace is replaced with underscores,
+// which is how Hypnohub spells spaces in tag names.
+//
+// Hypnohub has no way to quote the rest of its syntax, so tags that would
+// change the meaning of a query are rejected with an error wrapping
+// [ErrInvalidTag] rather than rewritten:
+//
+//   - Tags containing '{', '}', '~' or '*', which are grouping, OR, fuzzy and
+//     wildcard operators respectively.
+//   - Tags starting with '-', which negates the tag.
+//   - Tags starting with a metatag name followed by ':', such as sort:random
+//     or id:>5. Other tags containing ':' are matched literally.
+func EscapeTag(s string) (string, error) {
+	s = strings.Join(strings.Fields(s), "_")
+
+	if i := strings.IndexAny(s, "{}~*"); i != -1 {
+		return "", fmt.Errorf("%w %q: %q is an operator", ErrInvalidTag, s, s[i])
+	}
+	if strings.HasPrefix(s, "-") {
+		return "", fmt.Errorf("%w %q: leading '-' negates the tag", ErrInvalidTag, s)
+	}
+	if name, _, ok := strings.Cut(s, ":"); ok && slices.Contains(metatags, strings.ToLower(name)) {
+		return "", fmt.Errorf("%w %q: %s: is a metatag", ErrInvalidTag, s, name)
+	}
+
+	return s, nil
+}
+
+// escapedQuery returns a Query with the given tag escaped and wrapped with the
+// given prefix and suffix. If the escaped tag is empty, then nil is returned.
+func escapedQuery(prefix, tag, suffix string) (Query, error) {
+	tag, err := EscapeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	if tag == "" {
+		return nil, nil
+	}
+	return Query{prefix + tag + suffix}, nil
+}
+
+// literalQuery is like escapedQuery, but uses a tag that cannot be escaped as
+// it is, only replacing its whitespace.
+func literalQuery(prefix, tag, suffix string) Query {
+	q, err := escapedQuery(prefix, tag, suffix)
+	if err != nil {
+		return Query{prefix + strings.Join(strings.Fields(tag), "_") + suffix}
+	}
+	return q
 }
 
 // And joins the given queries together. The default behavior of each query item
@@ -33,56 +141,160 @@ func And(qs ...Query) Query {
 	return qn
 }
 
-// Not negates the given query.
+// Not negates the given queries joined with [And]. The given queries are not
+// modified.
+//
+// Since Hypnohub cannot negate an OR group, De Morgan's laws are applied so
+// that the returned query is always valid: negating (a OR b) gives
+// (-a AND -b), and negating (a AND b) gives (-a OR -b).
 func Not(qs ...Query) Query {
-	q := And(qs...)
-	for i, s := range q {
-		q[i] = "-" + s
+	clauses := And(qs...).clauses()
+	negated := make([]Query, len(clauses))
+	for i, c := range clauses {
+		q := make(Query, len(c))
+		for j, t := range c {
+			q[j] = t.negate().String()
+		}
+		negated[i] = q
 	}
-	return q
+	return Or(negated...)
 }
 
-// Or combines the given queries with an OR operator.
-// The returned query will be of length 1, where the first element is the
-// combined query.
+// Or combines the given queries with an OR operator. Empty queries are
+// ignored.
+//
+// Hypnohub can only express OR groups of plain tags, so OR is distributed
+// over AND as needed: (a AND b) OR c becomes (a OR c) AND (b OR c). The
+// returned query is simplified using [Simplify].
 func Or(qs ...Query) Query {
-	q1 := strings.Join([]string(And(qs...)), " ~ ")
-	return Query{"{" + q1 + "}"}
+	return fromClauses(simplify(distribute(qs)))
+}
+
+// Simplify returns a simplified copy of the given query. It removes duplicate
+// tags within OR groups, OR groups that always match (such as {a ~ -a}),
+// duplicate elements, and OR groups that are made redundant by a stricter
+// element (such as {a ~ b} when a is also required).
+func Simplify(q Query) Query {
+	return fromClauses(simplify(q.clauses()))
+}
+
+func simplify(clauses []clause) []clause {
+	deduped := make([]clause, 0, len(clauses))
+	for _, c := range clauses {
+		c = c.dedup()
+		if !c.isTautology() {
+			deduped = append(deduped, c)
+		}
+	}
+
+	out := make([]clause, 0, len(deduped))
+	for i, c := range deduped {
+		redundant := false
+		for j, other := range deduped {
+			if i == j || !other.isSubsetOf(c) {
+				continue
+			}
+			// Only drop c if other is strictly smaller, or if it's an earlier
+			// duplicate of c.
+			if len(other) < len(c) || j < i {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			out = append(out, c)
+		}
+	}
+	return out
 }
 
 // Fuzzy applies the fuzzy search operator to the given query.
 // Queries with this operator will return results that are similar to the
 // query, but not necessarily matching it, based on the Levenshtein distance.
 func Fuzzy(q Query) Query {
-	q = slices.Clone(q)
-	for i, s := range q {
-		q[i] = s + "~"
-	}
-	return q
+	return mapTerms(q, func(t term) term {
+		t.tag += "~"
+		return t
+	})
+}
+
+// Prefix returns a Query that matches all tags starting with the given
+// string. Like [Tag], the string is used as it is if it cannot be escaped.
+func Prefix(s string) Query {
+	return literalQuery("", s, "*")
 }
 
-// HasPrefix applies the prefix search operator to the given query.
+// EscapedPrefix is like [Prefix], but returns an error if the string cannot be
+// escaped. See [EscapedTag].
+func EscapedPrefix(s string) (Query, error) {
+	return escapedQuery("", s, "*")
+}
+
+// Suffix returns a Query that matches all tags ending with the given string.
+// Like [Tag], the string is used as it is if it cannot be escaped.
+func Suffix(s string) Query {
+	return literalQuery("*", s, "")
+}
+
+// EscapedSuffix is like [Suffix], but returns an error if the string cannot be
+// escaped. See [EscapedTag].
+func EscapedSuffix(s string) (Query, error) {
+	return escapedQuery("*", s, "")
+}
+
+// Contains returns a Query that matches all tags containing the given string.
+// Like [Tag], the string is used as it is if it cannot be escaped.
+func Contains(s string) Query {
+	return literalQuery("*", s, "*")
+}
+
+// EscapedContains is like [Contains], but returns an error if the string
+// cannot be escaped. See [EscapedTag].
+func EscapedContains(s string) (Query, error) {
+	return escapedQuery("*", s, "*")
+}
+
+// HasSuffix applies the suffix search operator to the given query.
+//
+// Deprecated: Use [Suffix] instead, which also escapes the tag.
 func HasSuffix(q Query) Query {
-	q = slices.Clone(q)
-	for i, s := range q {
-		q[i] = "*" + s
-	}
-	return q
+	return mapTerms(q, func(t term) term {
+		t.tag = "*" + t.tag
+		return t
+	})
 }
 
 // User adds a user filter to the given query.
 func User(u string) Query {
-	return Query{"user:" + u}
+	return literalQuery("user:", u, "")
+}
+
+// EscapedUser is like [User], but returns an error if the user cannot be
+// escaped. See [EscapedTag].
+func EscapedUser(u string) (Query, error) {
+	return escapedQuery("user:", u, "")
 }
 
 // MD5 adds an MD5 filter to the given query.
 func MD5(md5 string) Query {
-	return Query{"md5:" + md5}
+	return literalQuery("md5:", md5, "")
 }
 
 // Rating adds a rating filter to the given query.
 func Rating(rating hypnohub.Rating) Query {
-	return Query{"rating:" + string(rating)}
+	return literalQuery("rating:", string(rating), "")
+}
+
+// Status adds a post status filter to the given query, such as "active",
+// "pending" or "deleted".
+func Status(status string) Query {
+	return literalQuery("status:", status, "")
+}
+
+// EscapedStatus is like [Status], but returns an error if the status cannot be
+// escaped. See [EscapedTag].
+func EscapedStatus(status string) (Query, error) {
+	return escapedQuery("status:", status, "")
 }
 
 // Pool adds a pool filter to the given query.
@@ -158,6 +370,31 @@ func Sort(opt SortOption, order SortOrder) Query {
 	return Query{"sort:" + string(opt) + ":" + string(order)}
 }
 
+// SortBy returns the sort option and order used by the query. If the query
+// has no sort, then Hypnohub's default of sorting by descending ID is
+// returned. If the query is sorted randomly, then ok is false.
+func (q Query) SortBy() (opt SortOption, order SortOrder, ok bool) {
+	opt, order = SortID, SortDescending
+	for _, c := range q.clauses() {
+		if len(c) != 1 || c[0].negated {
+			continue
+		}
+		sort, isSort := strings.CutPrefix(c[0].tag, "sort:")
+		if !isSort {
+			continue
+		}
+		o, ord, _ := strings.Cut(sort, ":")
+		if o == "random" {
+			return "", "", false
+		}
+		opt, order = SortOption(o), SortDescending
+		if ord == string(SortAscending) {
+			order = SortAscending
+		}
+	}
+	return opt, order, true
+}
+
 // String builds the query into a string.
 func (q Query) String() string {
 	return strings.Join([]string(q), " ")
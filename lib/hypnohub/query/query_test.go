@@ -1,6 +1,8 @@
 package query
 
 import (
+	"errors"
+	"slices"
 	"testing"
 
 	"libdb.so/hypnoview/lib/hypnohub"
@@ -23,6 +25,66 @@ func TestQuery(t *testing.T) {
 			ID(GreaterEqual, 3000),
 			"id:>=3000",
 		},
+		{
+			Prefix("hypno"),
+			"hypno*",
+		},
+		{
+			Suffix("_eyes"),
+			"*_eyes",
+		},
+		{
+			Contains("spiral"),
+			"*spiral*",
+		},
+		{
+			And(Tag("pleated skirt"), Tag("re:zero")),
+			"pleated_skirt re:zero",
+		},
+		{
+			And(Tag(" "), Prefix("")),
+			"",
+		},
+		{
+			Not(Or(Tag("skirt"), Tag("dress"))),
+			"-skirt -dress",
+		},
+		{
+			Not(Tag("skirt"), Tag("dress")),
+			"{-skirt ~ -dress}",
+		},
+		{
+			Not(Not(Tag("skirt"))),
+			"skirt",
+		},
+		{
+			Not(And(Tag("a"), Or(Tag("b"), Tag("c")))),
+			"{-a ~ -b} {-a ~ -c}",
+		},
+		{
+			Or(And(Tag("a"), Tag("b")), Tag("c")),
+			"{a ~ c} {b ~ c}",
+		},
+		{
+			Or(Tag("a"), Tag("a"), Tag("b")),
+			"{a ~ b}",
+		},
+		{
+			Or(Tag("a"), Not(Tag("a"))),
+			"",
+		},
+		{
+			Or(Tag("a"), nil),
+			"a",
+		},
+		{
+			Fuzzy(And(Tag("a"), Or(Tag("b"), Tag("c")))),
+			"a~ {b~ ~ c~}",
+		},
+		{
+			Simplify(And(Tag("a"), Or(Tag("a"), Tag("b")), Tag("a"))),
+			"a",
+		},
 	}
 
 	for _, test := range tests {
@@ -31,3 +93,161 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestEscapeTag(t *testing.T) {
+	tests := []struct {
+		tag    string
+		expect string
+		valid  bool
+	}{
+		{"skirt", "skirt", true},
+		{"pleated skirt", "pleated_skirt", true},
+		{"  pleated \t skirt  ", "pleated_skirt", true},
+		{"skirt-", "skirt-", true},
+		{"re:zero", "re:zero", true},
+		{"", "", true},
+		{"-skirt", "", false},
+		{"--skirt", "", false},
+		{"skirt~", "", false},
+		{"a ~ b", "", false},
+		{"{a}", "", false},
+		{"*skirt*", "", false},
+		{"sort:random", "", false},
+		{"id:>5", "", false},
+		{"Rating:e", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := EscapeTag(test.tag)
+		if test.valid != (err == nil) {
+			t.Errorf("EscapeTag(%q): unexpected error %v", test.tag, err)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("EscapeTag(%q): expected ErrInvalidTag, got %v", test.tag, err)
+		}
+		if got != test.expect {
+			t.Errorf("EscapeTag(%q): expected %q, got %q", test.tag, test.expect, got)
+		}
+	}
+}
+
+func TestEscapedConstructors(t *testing.T) {
+	for name, test := range map[string]struct {
+		literal func() Query
+		escaped func() (Query, error)
+		want    string
+	}{
+		"Tag": {
+			func() Query { return Tag("sort:random") },
+			func() (Query, error) { return EscapedTag("sort:random") },
+			"sort:random",
+		},
+		"Prefix": {
+			func() Query { return Prefix("-a") },
+			func() (Query, error) { return EscapedPrefix("-a") },
+			"-a*",
+		},
+		"Suffix": {
+			func() Query { return Suffix("{a") },
+			func() (Query, error) { return EscapedSuffix("{a") },
+			"*{a",
+		},
+		"Contains": {
+			func() Query { return Contains("a* b") },
+			func() (Query, error) { return EscapedContains("a* b") },
+			"*a*_b*",
+		},
+		"Status": {
+			func() Query { return Status("a*") },
+			func() (Query, error) { return EscapedStatus("a*") },
+			"status:a*",
+		},
+		"NewQuery": {
+			func() Query { return NewQuery("a", "id:>5") },
+			func() (Query, error) { return NewEscapedQuery("a", "id:>5") },
+			"a id:>5",
+		},
+	} {
+		if q := test.literal(); q.String() != test.want {
+			t.Errorf("%s: expected %q, got %q", name, test.want, q)
+		}
+		if _, err := test.escaped(); !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("%s: expected ErrInvalidTag, got %v", name, err)
+		}
+	}
+
+	q, err := NewEscapedQuery("pleated skirt", "re:zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.String() != "pleated_skirt re:zero" {
+		t.Errorf("unexpected escaped query %q", q)
+	}
+}
+
+func TestNotDoesNotMutate(t *testing.T) {
+	q := And(Tag("skirt"), Tag("dress"))
+	Not(q)
+	if q.String() != "skirt dress" {
+		t.Errorf("Not mutated its input into %q", q.String())
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	limits := Limits{MaxTags: 6, MaxOrTerms: 4}
+
+	small := And(Tag("skirt"), Or(Tag("a"), Tag("b")))
+	if err := small.CheckLimits(limits); err != nil {
+		t.Errorf("expected no error for %q, got %v", small, err)
+	}
+
+	large := And(Tag("skirt"), Or(Tag("a"), Tag("b"), Tag("c"), Tag("d"), Tag("e"), Tag("f")))
+	cost := large.Cost()
+	if cost != (Cost{Tags: 7, OrTerms: 6}) {
+		t.Errorf("unexpected cost %+v", cost)
+	}
+
+	err := large.CheckLimits(limits)
+	limitErr, ok := err.(*LimitError)
+	if !ok {
+		t.Fatalf("expected *LimitError, got %v", err)
+	}
+
+	var split []string
+	for _, q := range limitErr.Split {
+		split = append(split, q.String())
+	}
+	expect := []string{"skirt {a ~ b ~ c}", "skirt {d ~ e ~ f}"}
+	if !slices.Equal(split, expect) {
+		t.Errorf("expected split %q, got %q", expect, split)
+	}
+
+	wildcards := And(Prefix("a"), Prefix("b"), Prefix("c"))
+	err = wildcards.CheckLimits(Limits{MaxWildcards: 2})
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Split != nil {
+		t.Errorf("expected unsplittable *LimitError, got %v", err)
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	tests := []struct {
+		query Query
+		opt   SortOption
+		order SortOrder
+		ok    bool
+	}{
+		{Tag("skirt"), SortID, SortDescending, true},
+		{And(Tag("skirt"), Sort(SortScore, SortAscending)), SortScore, SortAscending, true},
+		{Query{"sort:width"}, SortWidth, SortDescending, true},
+		{SortRandomWithSeed(42), "", "", false},
+	}
+
+	for _, test := range tests {
+		opt, order, ok := test.query.SortBy()
+		if opt != test.opt || order != test.order || ok != test.ok {
+			t.Errorf("%q: expected (%v, %v, %v), got (%v, %v, %v)",
+				test.query, test.opt, test.order, test.ok, opt, order, ok)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Package splitsearch runs queries that exceed Hypnohub's limits by splitting
+// them into multiple smaller queries and merging their results.
+package splitsearch
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/query"
+)
+
+// PostsSearcher is an interface that allows searching for posts.
+// It is implemented by [hypnohub.Client].
+type PostsSearcher interface {
+	SearchPosts(ctx context.Context, query string, postOffset int) (*hypnohub.SearchPostsResult, error)
+}
+
+var _ PostsSearcher = (*hypnohub.Client)(nil)
+
+// DefaultMaxParallel is the default maximum number of upstream queries that
+// an [Executor] runs at once.
+const DefaultMaxParallel = 4
+
+// Executor runs queries against a [PostsSearcher]. Queries that exceed the
+// configured limits are split into multiple upstream queries using
+// [query.Query.Split], and their results are de-duplicated and merged back
+// into a single paginated result.
+type Executor struct {
+	// Searcher is the searcher to run upstream queries with.
+	Searcher PostsSearcher
+	// Limits are the backend limits. If zero, then [query.DefaultLimits] is
+	// used.
+	Limits query.Limits
+	// MaxParallel is the maximum number of upstream queries to run at once.
+	// If 0, then [DefaultMaxParallel] is used.
+	MaxParallel int
+	// PageSize is the number of posts to return per page. If 0, then
+	// [hypnohub.PostsPerPage] is used.
+	PageSize int
+}
+
+// NewExecutor creates a new Executor with the default options.
+func NewExecutor(searcher PostsSearcher) *Executor {
+	return &Executor{Searcher: searcher}
+}
+
+// Search runs the given query and returns the page of posts starting at the
+// given post offset.
+//
+// If the query is split, then posts are merged in the order given by the
+// query's sort (see [query.Query.SortBy]). Randomly sorted queries are merged
+// by descending ID. The returned Count is the sum of the counts of each
+// upstream query, so it may be higher than the actual number of posts.
+func (e *Executor) Search(ctx context.Context, q query.Query, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	limits := e.Limits
+	if limits == (query.Limits{}) {
+		limits = query.DefaultLimits
+	}
+
+	var limitErr *query.LimitError
+	if err := q.CheckLimits(limits); !errors.As(err, &limitErr) || limitErr.Split == nil {
+		// Either the query is within the limits, or it cannot be split, in
+		// which case we let the backend decide what to do with it.
+		return e.Searcher.SearchPosts(ctx, q.String(), postOffset)
+	}
+
+	pageSize := e.PageSize
+	if pageSize == 0 {
+		pageSize = hypnohub.PostsPerPage
+	}
+
+	// In the worst case, every post that we need comes from the same
+	// upstream query, so each of them needs to be fetched this far.
+	need := postOffset + pageSize
+
+	results, err := e.searchAll(ctx, limitErr.Split, need)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	seen := make(map[hypnohub.PostID]struct{})
+	var posts []hypnohub.Post
+	for _, result := range results {
+		count += result.Count
+		for _, post := range result.Posts {
+			if _, ok := seen[post.ID]; !ok {
+				seen[post.ID] = struct{}{}
+				posts = append(posts, post)
+			}
+		}
+	}
+
+	slices.SortStableFunc(posts, comparePosts(q))
+
+	start := min(postOffset, len(posts))
+	end := min(postOffset+pageSize, len(posts))
+
+	return &hypnohub.SearchPostsResult{
+		Posts:  posts[start:end],
+		Count:  count,
+		Offset: postOffset,
+	}, nil
+}
+
+// searchAll runs each query concurrently, fetching at least need posts for
+// each of them unless they run out of posts.
+func (e *Executor) searchAll(ctx context.Context, qs []query.Query, need int) ([]*hypnohub.SearchPostsResult, error) {
+	maxParallel := e.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = DefaultMaxParallel
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*hypnohub.SearchPostsResult, len(qs))
+	errs := make([]error, len(qs))
+	sema := make(chan struct{}, maxParallel)
+
+	var wg sync.WaitGroup
+	for i, q := range qs {
+		wg.Add(1)
+		go func(i int, q query.Query) {
+			defer wg.Done()
+
+			sema <- struct{}{}
+			defer func() { <-sema }()
+
+			results[i], errs[i] = e.searchN(ctx, q.String(), need)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, q)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// searchN fetches pages of the given query until at least n posts are
+// fetched or there are no more posts.
+func (e *Executor) searchN(ctx context.Context, q string, n int) (*hypnohub.SearchPostsResult, error) {
+	var result hypnohub.SearchPostsResult
+	for len(result.Posts) < n {
+		page, err := e.Searcher.SearchPosts(ctx, q, len(result.Posts))
+		if err != nil {
+			return nil, fmt.Errorf("searching %q: %w", q, err)
+		}
+
+		result.Count = page.Count
+		result.Posts = append(result.Posts, page.Posts...)
+
+		if len(page.Posts) == 0 || len(result.Posts) >= page.Count {
+			break
+		}
+	}
+	return &result, nil
+}
+
+// comparePosts returns a comparison function that orders posts the same way
+// that Hypnohub orders the results of the given query.
+func comparePosts(q query.Query) func(a, b hypnohub.Post) int {
+	opt, order, ok := q.SortBy()
+	if !ok {
+		opt, order = query.SortID, query.SortDescending
+	}
+
+	var key func(a, b hypnohub.Post) int
+	switch opt {
+	case query.SortScore:
+		key = func(a, b hypnohub.Post) int { return cmp.Compare(a.Score, b.Score) }
+	case query.SortRating:
+		key = func(a, b hypnohub.Post) int { return cmp.Compare(a.Rating, b.Rating) }
+	case query.SortUser:
+		key = func(a, b hypnohub.Post) int { return cmp.Compare(a.CreatorID, b.CreatorID) }
+	case query.SortWidth:
+		key = func(a, b hypnohub.Post) int { return cmp.Compare(a.Width, b.Width) }
+	case query.SortHeight:
+		key = func(a, b hypnohub.Post) int { return cmp.Compare(a.Height, b.Height) }
+	case query.SortSource:
+		key = func(a, b hypnohub.Post) int { return cmp.Compare(a.Source, b.Source) }
+	case query.SortUpdated:
+		key = func(a, b hypnohub.Post) int { return cmp.Compare(a.ChangedAt, b.ChangedAt) }
+	default:
+		key = func(a, b hypnohub.Post) int { return 0 }
+	}
+
+	return func(a, b hypnohub.Post) int {
+		c := key(a, b)
+		if c == 0 {
+			c = cmp.Compare(a.ID, b.ID)
+		}
+		if order == query.SortDescending {
+			c = -c
+		}
+		return c
+	}
+}
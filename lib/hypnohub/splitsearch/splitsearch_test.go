@@ -0,0 +1,131 @@
+package splitsearch
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"libdb.so/hypnoview/lib/hypnohub"
+	"libdb.so/hypnoview/lib/hypnohub/query"
+)
+
+func TestExecutor(t *testing.T) {
+	searcher := &mockPostsSearcher{
+		posts: []hypnohub.Post{
+			{ID: 1, Score: 10, Tags: "a b"},
+			{ID: 2, Score: 50, Tags: "c"},
+			{ID: 3, Score: 30, Tags: "d e"},
+			{ID: 4, Score: 20, Tags: "f"},
+			{ID: 5, Score: 40, Tags: "a f"},
+			{ID: 6, Score: 60, Tags: "g"},
+		},
+	}
+
+	executor := &Executor{
+		Searcher: searcher,
+		Limits:   query.Limits{MaxOrTerms: 2},
+		PageSize: 2,
+	}
+
+	q := query.And(
+		query.Or(query.Tag("a"), query.Tag("b"), query.Tag("c"), query.Tag("d"), query.Tag("f")),
+		query.Sort(query.SortScore, query.SortDescending),
+	)
+
+	tests := []struct {
+		offset int
+		want   []hypnohub.PostID
+	}{
+		{0, []hypnohub.PostID{2, 5}},
+		{2, []hypnohub.PostID{3, 4}},
+		{4, []hypnohub.PostID{1}},
+		{6, []hypnohub.PostID{}},
+	}
+
+	for _, test := range tests {
+		result, err := executor.Search(context.Background(), q, test.offset)
+		if err != nil {
+			t.Fatalf("offset %d: unexpected error: %v", test.offset, err)
+		}
+
+		ids := make([]hypnohub.PostID, len(result.Posts))
+		for i, post := range result.Posts {
+			ids[i] = post.ID
+		}
+		if !slices.Equal(ids, test.want) {
+			t.Errorf("offset %d: expected %v, got %v", test.offset, test.want, ids)
+		}
+	}
+
+	for _, q := range searcher.queries {
+		if err := query.MustParse(q).CheckLimits(executor.Limits); err != nil {
+			t.Errorf("upstream query %q exceeds limits: %v", q, err)
+		}
+	}
+}
+
+// mockPostsSearcher is a PostsSearcher that evaluates simple queries against
+// a list of posts. It only understands tags, OR groups and score sorting.
+type mockPostsSearcher struct {
+	mu      sync.Mutex
+	posts   []hypnohub.Post
+	queries []string
+}
+
+func (s *mockPostsSearcher) SearchPosts(ctx context.Context, q string, postOffset int) (*hypnohub.SearchPostsResult, error) {
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+
+	var groups [][]string
+	var group []string
+	var inGroup, sortScore bool
+	for _, field := range strings.Fields(q) {
+		switch {
+		case field == "sort:score:desc":
+			sortScore = true
+		case strings.HasPrefix(field, "{"):
+			inGroup = true
+			group = []string{strings.TrimPrefix(field, "{")}
+		case strings.HasSuffix(field, "}"):
+			inGroup = false
+			groups = append(groups, append(group, strings.TrimSuffix(field, "}")))
+		case inGroup:
+			if field != "~" {
+				group = append(group, field)
+			}
+		default:
+			groups = append(groups, []string{field})
+		}
+	}
+
+	var matched []hypnohub.Post
+	for _, post := range s.posts {
+		tags := post.Tags.Split()
+		if !slices.ContainsFunc(groups, func(group []string) bool {
+			return !slices.ContainsFunc(group, func(tag string) bool { return slices.Contains(tags, tag) })
+		}) {
+			matched = append(matched, post)
+		}
+	}
+
+	slices.SortFunc(matched, func(a, b hypnohub.Post) int {
+		if sortScore {
+			return cmp.Compare(b.Score, a.Score)
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+
+	const limit = 1
+	start := min(postOffset, len(matched))
+	end := min(postOffset+limit, len(matched))
+
+	return &hypnohub.SearchPostsResult{
+		Posts:  matched[start:end],
+		Count:  len(matched),
+		Offset: postOffset,
+	}, nil
+}